@@ -0,0 +1,174 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenClockSkew is how far in the future a derived token's timestamp may be,
+// allowing for servers with slightly different clocks.
+const tokenClockSkew = time.Minute
+
+/*
+SetActionTokenKeys switches action tokens to being derived by HMAC from the
+session id, an action name and a timestamp, rather than stored in the session.
+Derived tokens need no storage write and stay valid for validity after they
+are issued, so tokens issued to several tabs are all accepted.
+
+The first key signs new tokens, all keys are accepted when verifying, so keys
+can be rotated as with SetSigningKeys. Keys must be at least 32 bytes and
+should differ from the signing keys. Calling with no keys returns to stored
+tokens.
+
+Tokens are bound to the session id and are invalidated by Regenerate.
+*/
+func (sm *SessionManager) SetActionTokenKeys(validity time.Duration, keys ...[]byte) error {
+	if len(keys) != 0 && validity < time.Minute {
+		return errors.New("action token validity too short")
+	}
+	for _, key := range keys {
+		if len(key) < 32 {
+			return errors.New("action token key too short, need at least 32 bytes")
+		}
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.actionKeys = copyKeys(keys)
+	sm.actionValidity = validity
+	return nil
+}
+
+// derivedTokens reports whether action tokens are derived rather than stored.
+func (sm *SessionManager) derivedTokens() bool {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	return len(sm.actionKeys) != 0
+}
+
+/*
+ActionTokenFor returns a token accepted only by CanActFor with the same action,
+or by CanAct for requests to the path given as action. Use the form's action
+path or another name for the operation, "" is the token from ActionToken.
+
+Without SetActionTokenKeys the action is ignored and ActionToken is returned.
+*/
+func (s *Session) ActionTokenFor(action string) string {
+	s.sm.RLock()
+	keys := s.sm.actionKeys
+	s.sm.RUnlock()
+
+	if len(keys) == 0 {
+		return s.ActionToken()
+	}
+
+	sid := s.tokenSID()
+	if sid == "" {
+		return "error"
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return ts + "." + base64.RawURLEncoding.EncodeToString(actionMAC(keys[0], sid, action, ts))
+}
+
+/*
+CanActFor is CanAct for a token from ActionTokenFor with action.
+*/
+func (s *Session) CanActFor(action string) bool {
+	if !s.sm.derivedTokens() {
+		return s.CanAct()
+	}
+	return s.canAct(func() bool {
+		return s.validDerivedToken(s.requestToken(), action)
+	})
+}
+
+// tokenSID returns the session id tokens are bound to, assigning lazy sessions
+// one first. Sessions that can't be written are never assigned an id, as it
+// would be locked and sent with nothing left to commit it.
+func (s *Session) tokenSID() string {
+	if s.readOnly {
+		s.RLock()
+		defer s.RUnlock()
+		return s.sid
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.checkWritable() != nil {
+		return s.sid
+	}
+	s.materialize()
+	return s.sid
+}
+
+// requestPath returns the path of the session's request.
+func (s *Session) requestPath() string {
+	if s.req == nil || s.req.URL == nil {
+		return ""
+	}
+	return s.req.URL.Path
+}
+
+// validDerivedToken checks token, plain or masked, was derived for one of
+// actions within the validity window.
+func (s *Session) validDerivedToken(token string, actions ...string) bool {
+	s.sm.RLock()
+	keys := s.sm.actionKeys
+	validity := s.sm.actionValidity
+	s.sm.RUnlock()
+
+	// Masking uses base64url, which has no ".".
+	if !strings.Contains(token, ".") {
+		token = unmaskToken(token)
+	}
+
+	ts, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > validity || age < -tokenClockSkew {
+		return false
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return false
+	}
+
+	s.RLock()
+	sid := s.sid
+	s.RUnlock()
+	if sid == "" {
+		return false
+	}
+
+	for _, key := range keys {
+		for _, action := range actions {
+			if hmac.Equal(mac, actionMAC(key, sid, action, ts)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func actionMAC(key []byte, sid string, action string, ts string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(sid + "\x00" + action + "\x00" + ts))
+	return h.Sum(nil)
+}
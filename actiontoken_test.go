@@ -0,0 +1,84 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_DerivedActionTokens(t *testing.T) {
+	sm, _ := newTestSession(t)
+	defer sm.Close()
+
+	if err := sm.SetActionTokenKeys(time.Hour, []byte("short")); err == nil {
+		t.Errorf("short action token key accepted")
+	}
+	if err := sm.SetActionTokenKeys(time.Second, bytes.Repeat([]byte("k"), 32)); err == nil {
+		t.Errorf("one second validity accepted")
+	}
+
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	key := bytes.Repeat([]byte("k"), 32)
+	if err := sm.SetActionTokenKeys(time.Hour, oldKey); err != nil {
+		t.Fatalf("SetActionTokenKeys failed: %s", err)
+	}
+	_, ses := newTestSessionFor(t, sm)
+	defer ses.Commit()
+	issuedByOld := ses.ActionToken()
+	sm.SetActionTokenKeys(time.Hour, key, oldKey)
+
+	if _, stored := ses.Values["actionToken"]; stored {
+		t.Errorf("derived action token was stored in the session")
+	}
+
+	_, other := newTestSessionFor(t, sm)
+	defer other.Commit()
+
+	ts := strconv.FormatInt(time.Now().Add(-2*time.Hour).Unix(), 10)
+	expired := ts + "." + base64.RawURLEncoding.EncodeToString(actionMAC(key, ses.sid, "", ts))
+
+	tests := []struct {
+		token  string
+		path   string
+		action string
+		ok     bool
+	}{
+		{ses.ActionToken(), "/", "", true},
+		{ses.MaskedActionToken(), "/", "", true},
+		{issuedByOld, "/", "", true},
+		{ses.ActionTokenFor("delete"), "/", "delete", true},
+		{ses.ActionTokenFor("delete"), "/", "rename", false},
+		{ses.ActionTokenFor("/account/delete"), "/account/delete", "", true},
+		{ses.ActionTokenFor("/account/delete"), "/account/rename", "", false},
+		{other.ActionToken(), "/", "", false},
+		{expired, "/", "", false},
+		{"error", "/", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.path, nil)
+		r.Header.Set("X-CSRF-Token", tt.token)
+		ses.req = r
+
+		var ok bool
+		if tt.action != "" {
+			ok = ses.CanActFor(tt.action)
+		} else {
+			ok = ses.CanAct()
+		}
+		if ok != tt.ok {
+			t.Errorf("token '%s' for '%s' at %s accepted %v, expected %v", tt.token, tt.action, tt.path, ok, tt.ok)
+		}
+	}
+
+	// Moving the session invalidates its tokens.
+	token := ses.ActionToken()
+	ses.Regenerate()
+	ses.req.Header.Set("X-CSRF-Token", token)
+	if ses.CanAct() {
+		t.Errorf("token accepted after Regenerate")
+	}
+}
@@ -0,0 +1,205 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/*
+BindingPolicy is what Begin does when a session is presented by a client
+other than the one it is bound to.
+*/
+type BindingPolicy int
+
+const (
+	// BindReject gives the request a new empty session, the original
+	// session is left untouched for its owner.
+	BindReject BindingPolicy = iota
+
+	// BindRegenerate removes the session, as its id is known to another
+	// client, and gives the request a new empty session.
+	BindRegenerate
+
+	// BindFlag continues with the session and calls OnMismatch, which may
+	// Clear it, demand reauthentication or just log.
+	BindFlag
+)
+
+/*
+Binding ties sessions to attributes of the client that created them, so a
+stolen session id is of no use from a different client. See SetBinding.
+
+Bind only what is stable for your clients. User agents change on browser
+updates, mobile clients move between networks and TLS parameters can change
+with server configuration, each causing a mismatch.
+*/
+type Binding struct {
+	// UserAgent binds to a hash of the User-Agent header.
+	UserAgent bool
+
+	// IPv4Bits and IPv6Bits bind to the network prefix of that many bits of
+	// the client's address, such as 24 and 64. 0 ignores the address.
+	IPv4Bits int
+	IPv6Bits int
+
+	// ClientIP returns the client's address, by default
+	// SessionManager.ClientIP.
+	ClientIP func(req *http.Request) string
+
+	// TLS binds to the TLS version and cipher suite, or their absence.
+	TLS bool
+
+	Policy BindingPolicy
+
+	// OnMismatch is called with the session and request for BindFlag.
+	OnMismatch func(ses *Session, req *http.Request)
+}
+
+/*
+SetBinding enables binding new sessions to their client and checking the
+binding in Begin and BeginReadOnly. Sessions without a binding, such as those
+created before enabling it, and changes to the bound attributes cause a
+mismatch for every existing session.
+
+The fingerprint is kept with the session's metadata by the storage. Passing
+nil disables binding.
+*/
+func (sm *SessionManager) SetBinding(b *Binding) error {
+	if b != nil {
+		if !b.UserAgent && !b.TLS && b.IPv4Bits == 0 && b.IPv6Bits == 0 {
+			return errors.New("binding binds nothing")
+		}
+		if b.IPv4Bits < 0 || b.IPv4Bits > 32 || b.IPv6Bits < 0 || b.IPv6Bits > 128 {
+			return errors.New("invalid binding prefix length")
+		}
+		if b.Policy < BindReject || b.Policy > BindFlag {
+			return errors.New("invalid BindingPolicy")
+		}
+		if b.Policy == BindFlag && b.OnMismatch == nil {
+			return errors.New("BindFlag needs OnMismatch")
+		}
+
+		copied := *b
+		if copied.ClientIP == nil {
+			copied.ClientIP = sm.clientIP
+		}
+		b = &copied
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.binding = b
+	return nil
+}
+
+// fingerprint describes the bound attributes of the client making req.
+func (b *Binding) fingerprint(req *http.Request) string {
+	var parts []string
+
+	if b.UserAgent {
+		h := sha256.Sum256([]byte(req.UserAgent()))
+		parts = append(parts, "ua="+hex.EncodeToString(h[:8]))
+	}
+
+	if b.IPv4Bits != 0 || b.IPv6Bits != 0 {
+		parts = append(parts, "ip="+b.network(req))
+	}
+
+	if b.TLS {
+		tls := "none"
+		if req.TLS != nil {
+			tls = fmt.Sprintf("%04x/%04x", req.TLS.Version, req.TLS.CipherSuite)
+		}
+		parts = append(parts, "tls="+tls)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// network returns the client's address prefix, or "" if it's ignored.
+func (b *Binding) network(req *http.Request) string {
+	addr, err := netip.ParseAddr(b.ClientIP(req))
+	if err != nil {
+		return "unknown"
+	}
+	addr = addr.Unmap()
+
+	bits := b.IPv6Bits
+	if addr.Is4() {
+		bits = b.IPv4Bits
+	}
+	if bits == 0 {
+		return ""
+	}
+
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return "unknown"
+	}
+	return prefix.String()
+}
+
+// bindLocked binds a new session to its request's client. The session must be
+// locked.
+func (s *Session) bindLocked() {
+	s.sm.RLock()
+	b := s.sm.binding
+	s.sm.RUnlock()
+
+	if b == nil || s.req == nil {
+		return
+	}
+	s.binding = b.fingerprint(s.req)
+}
+
+/*
+checkBinding applies the binding policy to a session loaded by Begin. Returns
+true if the session was replaced by a new one, which has then been sent.
+Rejected sessions are released and left without Values.
+*/
+func (sm *SessionManager) checkBinding(s *Session) (bool, error) {
+	sm.RLock()
+	b := sm.binding
+	sm.RUnlock()
+
+	if b == nil {
+		return false, nil
+	}
+
+	// Unbound sessions could belong to anyone, so they mismatch too.
+	if s.binding == b.fingerprint(s.req) {
+		return false, nil
+	}
+
+	switch {
+	case b.Policy == BindFlag:
+		b.OnMismatch(s, s.req)
+		return false, nil
+
+	case b.Policy == BindRegenerate && !s.readOnly:
+		// Clear removes the session and binds its replacement to this
+		// client, nothing of the original is handed over.
+		err := s.Clear()
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	// Rejected, the session is only unlocked so its owner keeps it.
+	if !s.readOnly {
+		sm.unlockSID(s.sid, s.lock)
+	}
+	s.sid = ""
+	s.lock = nil
+	s.Values = nil
+	s.loaded = nil
+	s.sessionMeta = sessionMeta{}
+	return false, nil
+}
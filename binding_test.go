@@ -0,0 +1,127 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Binding(t *testing.T) {
+	sm, _ := newTestSession(t)
+	defer sm.Close()
+
+	if err := sm.SetBinding(&Binding{}); err == nil {
+		t.Errorf("empty binding accepted")
+	}
+	if err := sm.SetBinding(&Binding{UserAgent: true, Policy: BindFlag}); err == nil {
+		t.Errorf("BindFlag without OnMismatch accepted")
+	}
+
+	request := func(sid string, addr string, ua string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr + ":1234"
+		r.Header.Set("User-Agent", ua)
+		if sid != "" {
+			r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+		}
+		return r
+	}
+
+	begin := func(sid string, addr string, ua string) *Session {
+		ses, err := sm.Begin(httptest.NewRecorder(), request(sid, addr, ua))
+		if err != nil {
+			t.Fatalf("Begin failed: %s", err)
+		}
+		return ses
+	}
+
+	var flagged []string
+	binding := &Binding{
+		UserAgent: true,
+		IPv4Bits:  24,
+		IPv6Bits:  64,
+		OnMismatch: func(ses *Session, req *http.Request) {
+			flagged = append(flagged, ses.Get("user"))
+		},
+	}
+
+	for _, policy := range []BindingPolicy{BindReject, BindRegenerate, BindFlag} {
+		binding.Policy = policy
+		if err := sm.SetBinding(binding); err != nil {
+			t.Fatalf("SetBinding failed: %s", err)
+		}
+
+		ses := begin("", "192.0.2.10", "browser/1")
+		ses.Set("user", "bob")
+		ses.SetUserID("bob")
+		ses.Commit()
+		sid := ses.sid
+
+		// The same client, from elsewhere in its network.
+		ses = begin(sid, "192.0.2.99", "browser/1")
+		if ses.sid != sid || ses.Get("user") != "bob" {
+			t.Errorf("policy %d: session not resumed by its own client", policy)
+		}
+		if _, ok := ses.Values["clientBinding"]; ok || ses.binding == "" {
+			t.Errorf("policy %d: binding not kept in the metadata", policy)
+		}
+		ses.Commit()
+
+		// A different client.
+		ses = begin(sid, "198.51.100.1", "browser/1")
+		switch policy {
+		case BindReject:
+			if ses.sid == sid || ses.Get("user") != "" || ses.UserID() != "" {
+				t.Errorf("session used by a different client")
+			}
+			if ses.LastIP() != "198.51.100.1" {
+				t.Errorf("rejected client's session has LastIP '%s'", ses.LastIP())
+			}
+		case BindRegenerate:
+			if ses.sid == sid || ses.Get("user") != "" || ses.UserID() != "" {
+				t.Errorf("different client not given a new empty session")
+			}
+		case BindFlag:
+			if ses.sid != sid || len(flagged) != 1 || flagged[0] != "bob" {
+				t.Errorf("mismatch not flagged, got %v", flagged)
+			}
+		}
+		ses.Commit()
+
+		ro, err := sm.BeginReadOnly(httptest.NewRecorder(), request(sid, "192.0.2.10", "browser/2"))
+		if err != nil {
+			t.Fatalf("BeginReadOnly failed: %s", err)
+		}
+		if policy == BindReject && (ro.sid != "" || ro.Get("user") != "" || ro.UserID() != "") {
+			t.Errorf("read only session used by a different client, user id '%s'", ro.UserID())
+		}
+		if policy == BindReject && (ro.LastIP() != "" || ro.UserAgent() != "" || !ro.Created().IsZero()) {
+			t.Errorf("read only session shows the owner's metadata %s %s", ro.LastIP(), ro.UserAgent())
+		}
+
+		// Rejecting leaves the session to its owner, regenerating takes it
+		// away.
+		ses = begin(sid, "192.0.2.10", "browser/1")
+		if kept := ses.sid == sid; kept != (policy != BindRegenerate) {
+			t.Errorf("policy %d: original session kept %v", policy, kept)
+		}
+		ses.Commit()
+	}
+
+	// Sessions made before binding was enabled are not adopted.
+	sm.SetBinding(nil)
+	ses := begin("", "192.0.2.10", "browser/1")
+	ses.Set("user", "bob")
+	ses.Commit()
+	sid := ses.sid
+
+	binding.Policy = BindReject
+	if err := sm.SetBinding(binding); err != nil {
+		t.Fatalf("SetBinding failed: %s", err)
+	}
+	ses = begin(sid, "198.51.100.1", "browser/1")
+	if ses.sid == sid || ses.Get("user") != "" {
+		t.Errorf("unbound session adopted by the next client")
+	}
+	ses.Commit()
+}
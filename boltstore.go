@@ -2,8 +2,10 @@ package session
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -17,8 +19,26 @@ type BoltStore struct {
 
 	lastUsedName []byte
 	sessionsName []byte
+	metaName     []byte
+	usersName    []byte
 
 	maxAge time.Duration
+
+	maxLifetime time.Duration
+	idleTimeout time.Duration
+	sync.RWMutex
+}
+
+// boltMeta is stored gobbed in the meta bucket for each session.
+type boltMeta struct {
+	Created time.Time
+	Version uint64
+	UserID  string
+
+	LastIP    string
+	UserAgent string
+	Binding   string
+	Flashes   string
 }
 
 const TimeStampFormat = "2006-01-02 15:04:05.000"
@@ -37,6 +57,8 @@ func NewBoltStore(db *bolt.DB, maxAge time.Duration) (*BoltStore, error) {
 
 	s.lastUsedName = []byte("sessionsLastUsed")
 	s.sessionsName = []byte("sessions")
+	s.metaName = []byte("sessionsMeta")
+	s.usersName = []byte("sessionsUsers")
 
 	err := db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(s.lastUsedName)
@@ -47,6 +69,14 @@ func NewBoltStore(db *bolt.DB, maxAge time.Duration) (*BoltStore, error) {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(s.metaName)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(s.usersName)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 
@@ -64,28 +94,89 @@ func (s *BoltStore) Close() error {
 	return s.store.Close()
 }
 
+/*
+SetMaxLifetime sets the absolute lifetime of sessions measured from their
+creation. Zero disables the limit. Normally set through
+SessionManager.SetMaxLifetime.
+*/
+func (s *BoltStore) SetMaxLifetime(lifetime time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maxLifetime = lifetime
+	return nil
+}
+
+/*
+SetIdleTimeout expires sessions unused for timeout, when shorter than maxAge.
+Zero leaves expiry to maxAge. Normally set through
+SessionManager.SetIdleTimeout.
+*/
+func (s *BoltStore) SetIdleTimeout(timeout time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.idleTimeout = timeout
+	return nil
+}
+
 // GC one pass over the BoltStore
 func (s *BoltStore) GC() error {
 	err := s.store.Update(func(tx *bolt.Tx) error {
 		lastUsedBucket := tx.Bucket(s.lastUsedName)
 		sessionsBucket := tx.Bucket(s.sessionsName)
+		metaBucket := tx.Bucket(s.metaName)
 
+		// Buckets can't be modified during ForEach, collect first.
+		var expired [][]byte
 		lastUsedBucket.ForEach(func(k, v []byte) error {
-			var t time.Time
-			err := t.GobDecode(v)
-			if err != nil || time.Since(t) > s.maxAge {
-				lastUsedBucket.Delete(k)
-				sessionsBucket.Delete(k)
+			if s.expired(v, metaBucket.Get(k)) {
+				expired = append(expired, k)
 			}
 			return nil
 		})
 
+		for _, k := range expired {
+			s.unindex(tx, k)
+			lastUsedBucket.Delete(k)
+			sessionsBucket.Delete(k)
+			metaBucket.Delete(k)
+		}
+
 		return nil
 	})
 
 	return err
 }
 
+// expired checks the gobbed last used time and metadata of a session.
+func (s *BoltStore) expired(lastUsed []byte, metaGob []byte) bool {
+	s.RLock()
+	maxLifetime := s.maxLifetime
+	idleTimeout := s.idleTimeout
+	s.RUnlock()
+
+	var t time.Time
+	err := t.GobDecode(lastUsed)
+	if err != nil || time.Since(t) > s.maxAge {
+		return true
+	}
+	if idleTimeout != 0 && time.Since(t) > idleTimeout {
+		return true
+	}
+
+	if maxLifetime == 0 {
+		return false
+	}
+
+	// Sessions stored without metadata have an unknown age.
+	meta, err := ungobMeta(metaGob)
+	if err != nil || time.Since(meta.Created) > maxLifetime {
+		return true
+	}
+	return false
+}
+
 // Get session associated with sid.
 func (s *BoltStore) Get(sid string) (*Session, error) {
 	var ses Session
@@ -93,6 +184,7 @@ func (s *BoltStore) Get(sid string) (*Session, error) {
 	err := s.store.View(func(tx *bolt.Tx) error {
 		lastUsedBucket := tx.Bucket(s.lastUsedName)
 		sessionsBucket := tx.Bucket(s.sessionsName)
+		metaBucket := tx.Bucket(s.metaName)
 
 		bsid := []byte(sid)
 		lastUsed := lastUsedBucket.Get(bsid)
@@ -100,9 +192,8 @@ func (s *BoltStore) Get(sid string) (*Session, error) {
 			return nil
 		}
 
-		var t time.Time
-		err := t.GobDecode(lastUsed)
-		if err != nil || time.Since(t) > s.maxAge {
+		metaGob := metaBucket.Get(bsid)
+		if s.expired(lastUsed, metaGob) {
 			return nil
 		}
 
@@ -112,6 +203,17 @@ func (s *BoltStore) Get(sid string) (*Session, error) {
 		}
 
 		ses.Values, _ = ungobValues(sesGob)
+		ses.lastUsed.GobDecode(lastUsed)
+		meta, err := ungobMeta(metaGob)
+		if err == nil {
+			ses.created = meta.Created
+			ses.version = meta.Version
+			ses.userID = meta.UserID
+			ses.lastIP = meta.LastIP
+			ses.userAgent = meta.UserAgent
+			ses.binding = meta.Binding
+			ses.flashes = meta.Flashes
+		}
 		return nil
 	})
 
@@ -128,35 +230,239 @@ func (s *BoltStore) Get(sid string) (*Session, error) {
 
 // Commit session back to storage.
 func (s *BoltStore) Commit(ses *Session) error {
+	var version uint64
 	err := s.store.Update(func(tx *bolt.Tx) error {
-		lastUsedBucket := tx.Bucket(s.lastUsedName)
-		sessionsBucket := tx.Bucket(s.sessionsName)
+		var err error
+		version, err = s.put(tx, ses)
+		return err
+	})
 
-		bsid := []byte(ses.sid)
+	if err == nil {
+		ses.version = version
+	}
+	return err
+}
 
-		tb, err := time.Now().GobEncode()
-		if err != nil {
-			return err
+/*
+CommitVersion commits the session only if its version matches the stored
+session, otherwise returns ErrConflict. The check and write share a single
+transaction.
+*/
+func (s *BoltStore) CommitVersion(ctx context.Context, ses *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var version uint64
+	err := s.store.Update(func(tx *bolt.Tx) error {
+		meta, _ := ungobMeta(tx.Bucket(s.metaName).Get([]byte(ses.sid)))
+		if meta.Version != ses.version {
+			return ErrConflict
 		}
-		err = lastUsedBucket.Put(bsid, tb)
+
+		var err error
+		version, err = s.put(tx, ses)
+		return err
+	})
+
+	if err == nil {
+		ses.version = version
+	}
+	return err
+}
+
+// put writes the session within tx and returns its new version.
+func (s *BoltStore) put(tx *bolt.Tx, ses *Session) (uint64, error) {
+	lastUsedBucket := tx.Bucket(s.lastUsedName)
+	sessionsBucket := tx.Bucket(s.sessionsName)
+	metaBucket := tx.Bucket(s.metaName)
+
+	bsid := []byte(ses.sid)
+
+	tb, err := time.Now().GobEncode()
+	if err != nil {
+		return 0, err
+	}
+	err = lastUsedBucket.Put(bsid, tb)
+	if err != nil {
+		return 0, err
+	}
+
+	g, err := gobValues(ses.Values)
+	if err != nil {
+		return 0, err
+	}
+
+	err = sessionsBucket.Put(bsid, g)
+	if err != nil {
+		return 0, err
+	}
+
+	meta, _ := ungobMeta(metaBucket.Get(bsid))
+	if meta.UserID != ses.userID {
+		err = s.unindex(tx, bsid)
 		if err != nil {
-			return err
+			return 0, err
 		}
+		if ses.userID != "" {
+			err = tx.Bucket(s.usersName).Put(userKey(ses.userID, ses.sid), []byte{})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	meta.Created = ses.created
+	meta.Version++
+	meta.UserID = ses.userID
+	meta.LastIP = ses.lastIP
+	meta.UserAgent = ses.userAgent
+	meta.Binding = ses.binding
+	meta.Flashes = ses.flashes
+
+	m, err := gobMeta(meta)
+	if err != nil {
+		return 0, err
+	}
 
-		g, err := gobValues(ses.Values)
-		if err != nil {
-			return err
+	err = metaBucket.Put(bsid, m)
+	if err != nil {
+		return 0, err
+	}
+
+	return meta.Version, nil
+}
+
+// Touch updates the session's last used time.
+func (s *BoltStore) Touch(ses *Session) error {
+	err := s.store.Update(func(tx *bolt.Tx) error {
+		lastUsedBucket := tx.Bucket(s.lastUsedName)
+
+		bsid := []byte(ses.sid)
+		if lastUsedBucket.Get(bsid) == nil {
+			return nil
 		}
 
-		err = sessionsBucket.Put(bsid, g)
+		tb, err := time.Now().GobEncode()
 		if err != nil {
 			return err
 		}
+		return lastUsedBucket.Put(bsid, tb)
+	})
+
+	return err
+}
+
+// List the ids of all unexpired sessions.
+func (s *BoltStore) List() ([]string, error) {
+	var sids []string
+
+	err := s.store.View(func(tx *bolt.Tx) error {
+		metaBucket := tx.Bucket(s.metaName)
+
+		return tx.Bucket(s.lastUsedName).ForEach(func(k, v []byte) error {
+			if !s.expired(v, metaBucket.Get(k)) {
+				sids = append(sids, string(k))
+			}
+			return nil
+		})
+	})
+
+	return sids, err
+}
+
+/*
+SessionsForUser returns the ids of the unexpired sessions of uid, found through
+the sessionsUsers bucket keyed by user id and session id.
+*/
+func (s *BoltStore) SessionsForUser(uid string) ([]string, error) {
+	var sids []string
+	prefix := userKey(uid, "")
 
+	err := s.store.View(func(tx *bolt.Tx) error {
+		lastUsedBucket := tx.Bucket(s.lastUsedName)
+		metaBucket := tx.Bucket(s.metaName)
+
+		c := tx.Bucket(s.usersName).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			sid := k[len(prefix):]
+			lastUsed := lastUsedBucket.Get(sid)
+			if lastUsed != nil && !s.expired(lastUsed, metaBucket.Get(sid)) {
+				sids = append(sids, string(sid))
+			}
+		}
 		return nil
 	})
 
-	return err
+	return sids, err
+}
+
+// userKey returns the sessionsUsers key for a session of uid.
+func userKey(uid string, sid string) []byte {
+	return []byte(uid + "\x00" + sid)
+}
+
+// unindex removes the session from the user index within tx.
+func (s *BoltStore) unindex(tx *bolt.Tx, bsid []byte) error {
+	meta, err := ungobMeta(tx.Bucket(s.metaName).Get(bsid))
+	if err != nil || meta.UserID == "" {
+		return nil
+	}
+	return tx.Bucket(s.usersName).Delete(userKey(meta.UserID, string(bsid)))
+}
+
+// Count the unexpired sessions.
+func (s *BoltStore) Count() (int, error) {
+	count := 0
+
+	err := s.store.View(func(tx *bolt.Tx) error {
+		metaBucket := tx.Bucket(s.metaName)
+
+		return tx.Bucket(s.lastUsedName).ForEach(func(k, v []byte) error {
+			if !s.expired(v, metaBucket.Get(k)) {
+				count++
+			}
+			return nil
+		})
+	})
+
+	return count, err
+}
+
+/*
+Context aware variants. Bolt transactions can't be interrupted, so these only
+check ctx before starting.
+*/
+
+// GetContext gets the session associated with sid unless ctx is done.
+func (s *BoltStore) GetContext(ctx context.Context, sid string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(sid)
+}
+
+// CommitContext commits the session unless ctx is done.
+func (s *BoltStore) CommitContext(ctx context.Context, ses *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Commit(ses)
+}
+
+// TouchContext touches the session unless ctx is done.
+func (s *BoltStore) TouchContext(ctx context.Context, ses *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Touch(ses)
+}
+
+// DeleteContext deletes the session unless ctx is done.
+func (s *BoltStore) DeleteContext(ctx context.Context, ses *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(ses)
 }
 
 // Convert a map[string]string to a gobbed []byte
@@ -178,13 +484,41 @@ func ungobValues(v []byte) (map[string]string, error) {
 	return values, err
 }
 
+// Convert session metadata to a gobbed []byte
+func gobMeta(m boltMeta) ([]byte, error) {
+	b := &bytes.Buffer{}
+	g := gob.NewEncoder(b)
+
+	err := g.Encode(m)
+	return b.Bytes(), err
+}
+
+// Convert gobbed session metadata back to a boltMeta.
+func ungobMeta(v []byte) (boltMeta, error) {
+	var m boltMeta
+	if v == nil {
+		return m, errors.New("no metadata")
+	}
+
+	b := bytes.NewBuffer(v)
+	g := gob.NewDecoder(b)
+
+	err := g.Decode(&m)
+	return m, err
+}
+
 // Delete session from storage.
 func (s *BoltStore) Delete(ses *Session) error {
 	err := s.store.Update(func(tx *bolt.Tx) error {
 		lastUsedBucket := tx.Bucket(s.lastUsedName)
 		sessionsBucket := tx.Bucket(s.sessionsName)
 
-		err := lastUsedBucket.Delete([]byte(ses.sid))
+		err := s.unindex(tx, []byte(ses.sid))
+		if err != nil {
+			return err
+		}
+
+		err = lastUsedBucket.Delete([]byte(ses.sid))
 		if err != nil {
 			return err
 		}
@@ -194,6 +528,11 @@ func (s *BoltStore) Delete(ses *Session) error {
 			return err
 		}
 
+		err = tx.Bucket(s.metaName).Delete([]byte(ses.sid))
+		if err != nil {
+			return err
+		}
+
 		return nil
 	})
 
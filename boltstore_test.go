@@ -2,7 +2,7 @@ package session
 
 import (
 	"github.com/boltdb/bolt"
-	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -24,13 +24,15 @@ func Test_BoltStore(t *testing.T) {
 		t.Errorf("failed to create session manager: %s", err)
 		return
 	}
+	defer sm.Close()
 
 	memTest := SessionTestServer{t, sm}
-	go http.ListenAndServe(listen, memTest)
+	srv := httptest.NewServer(memTest)
+	defer srv.Close()
 
 	doneChan := make(chan bool)
 	go func() {
-		sessionTest(t)
+		sessionTest(t, srv.URL)
 		doneChan <- true
 	}()
 
@@ -41,4 +43,6 @@ func Test_BoltStore(t *testing.T) {
 	case <-timeout:
 		t.Fatalf("Timeout.")
 	}
+
+	typedValuesTest(t, sm)
 }
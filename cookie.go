@@ -0,0 +1,117 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+CookieConfig describes the session cookie, see NewSessionManagerWithCookie.
+*/
+type CookieConfig struct {
+	// Name of the cookie, required. Names prefixed with "__Secure-" or
+	// "__Host-" must meet the requirements browsers enforce for them.
+	Name string
+
+	// Domain and Path scope the cookie. Path defaults to "/".
+	Domain string
+	Path   string
+
+	// MaxAge defaults to 30 days. A negative MaxAge makes a browser session
+	// cookie, which is discarded when the browser closes.
+	MaxAge time.Duration
+
+	// SameSite is left unset by default, SameSiteNoneMode requires Secure.
+	SameSite http.SameSite
+
+	// Secure restricts the cookie to https. SessionManager.Secure may also be
+	// set after creation to the same effect.
+	Secure bool
+
+	// Partitioned stores the cookie separately for each top level site when
+	// embedded cross-site (CHIPS). Requires Secure.
+	Partitioned bool
+}
+
+const defaultCookieMaxAge = 30 * 24 * time.Hour
+
+// validate checks c for attribute combinations browsers would reject and
+// fills in defaults.
+func (c *CookieConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("invalid cookie Name")
+	}
+
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultCookieMaxAge
+	}
+
+	test := http.Cookie{Name: c.Name, Domain: c.Domain, Path: c.Path}
+	err := test.Valid()
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(c.Name, "__Secure-") && !c.Secure {
+		return errors.New("__Secure- cookies must be Secure")
+	}
+	if strings.HasPrefix(c.Name, "__Host-") {
+		if !c.Secure {
+			return errors.New("__Host- cookies must be Secure")
+		}
+		if c.Domain != "" {
+			return errors.New("__Host- cookies must not set a Domain")
+		}
+		if c.Path != "/" {
+			return errors.New("__Host- cookies must use Path \"/\"")
+		}
+	}
+
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.New("SameSite=None cookies must be Secure")
+	}
+	if c.Partitioned && !c.Secure {
+		return errors.New("Partitioned cookies must be Secure")
+	}
+
+	return nil
+}
+
+// cookie returns the cookie carrying value.
+func (c *CookieConfig) cookie(value string, secure bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:        c.Name,
+		Value:       value,
+		Domain:      c.Domain,
+		Path:        c.Path,
+		HttpOnly:    true,
+		Secure:      c.Secure || secure,
+		SameSite:    c.SameSite,
+		Partitioned: c.Partitioned,
+	}
+
+	if c.MaxAge > 0 {
+		cookie.MaxAge = int(c.MaxAge.Seconds())
+	}
+
+	return cookie
+}
+
+// SID returns the session cookie's value, making CookieConfig a Transport.
+func (c *CookieConfig) SID(req *http.Request) string {
+	sidCookie, err := req.Cookie(c.Name)
+	if err != nil {
+		return ""
+	}
+	return sidCookie.Value
+}
+
+// SetSID sets the session cookie, making CookieConfig a Transport.
+func (c *CookieConfig) SetSID(w http.ResponseWriter, value string, secure bool) {
+	http.SetCookie(w, c.cookie(value, secure))
+}
@@ -0,0 +1,84 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_CookieConfigValidation(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	defer store.Close()
+
+	bad := []CookieConfig{
+		{},
+		{Name: "bad name"},
+		{Name: "__Secure-sid"},
+		{Name: "__Host-sid"},
+		{Name: "__Host-sid", Secure: true, Domain: "example.com"},
+		{Name: "__Host-sid", Secure: true, Path: "/app"},
+		{Name: "sid", SameSite: http.SameSiteNoneMode},
+		{Name: "sid", Partitioned: true},
+	}
+	for _, c := range bad {
+		_, err := NewSessionManagerWithCookie(store, c)
+		if err == nil {
+			t.Errorf("config %+v accepted, expected an error", c)
+		}
+	}
+
+	good := []CookieConfig{
+		{Name: "sid"},
+		{Name: "__Secure-sid", Secure: true, Domain: "example.com"},
+		{Name: "__Host-sid", Secure: true, SameSite: http.SameSiteNoneMode, Partitioned: true},
+	}
+	for _, c := range good {
+		_, err := NewSessionManagerWithCookie(store, c)
+		if err != nil {
+			t.Errorf("config %+v rejected: %s", c, err)
+		}
+	}
+}
+
+func Test_CookieAttributes(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+
+	sm, err := NewSessionManagerWithCookie(store, CookieConfig{
+		Name:     "sid",
+		Domain:   "example.com",
+		Path:     "/app",
+		MaxAge:   -1,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	rec := httptest.NewRecorder()
+	ses, err := sm.Begin(rec, httptest.NewRequest("GET", "/app", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	ses.Commit()
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie got %d", len(cookies))
+	}
+
+	c := cookies[0]
+	if c.Domain != "example.com" || c.Path != "/app" || c.SameSite != http.SameSiteStrictMode || !c.HttpOnly {
+		t.Errorf("cookie attributes not applied: %+v", c)
+	}
+	if c.MaxAge != 0 || !c.Expires.IsZero() {
+		t.Errorf("expected a browser session cookie, got MaxAge %d Expires %s", c.MaxAge, c.Expires)
+	}
+}
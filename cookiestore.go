@@ -0,0 +1,345 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+CookieStore is a session storage that keeps sessions on the client inside
+AES-GCM encrypted cookies, leaving nothing to store server side. Payloads too
+large for a single cookie are split across several.
+
+Because the session travels in response headers it must be committed before the
+response is written. SessionManager.Middleware takes care of this, handlers
+calling Begin and Commit themselves must Commit before writing.
+
+The session id cookie is still managed by the SessionManager, the data cookies
+are named after the CookieConfig given to NewCookieStore with a chunk number
+appended, "Name.0", "Name.1" and so on.
+*/
+type CookieStore struct {
+	cookie CookieConfig
+	aeads  []cipher.AEAD
+
+	maxAge      time.Duration
+	maxLifetime time.Duration
+	idleTimeout time.Duration
+	sync.RWMutex
+}
+
+// cookiePayload is what gets encrypted into the data cookies.
+type cookiePayload struct {
+	SID     string            `json:"s"`
+	Values  map[string]string `json:"v"`
+	Created int64             `json:"c"`
+	Used    int64             `json:"u"`
+	Expires int64             `json:"e"`
+	UserID  string            `json:"i,omitempty"`
+	Commits uint64            `json:"n"`
+	LastIP  string            `json:"a"`
+	Agent   string            `json:"g"`
+	Binding string            `json:"b,omitempty"`
+	Flashes string            `json:"f,omitempty"`
+}
+
+const (
+	// cookieChunkSize leaves room for the name and attributes within the
+	// 4096 bytes browsers allow per cookie.
+	cookieChunkSize = 3800
+
+	// cookieMaxChunks bounds how many cookies a session may use.
+	cookieMaxChunks = 10
+)
+
+/*
+NewCookieStore returns a CookieStore SessionStorage. Sessions unused for
+maxAge expire. The first key encrypts, all keys are tried when decrypting so
+keys can be rotated without losing sessions. Keys must be 16, 24 or 32 bytes
+to select AES-128, AES-192 or AES-256.
+*/
+func NewCookieStore(cookie CookieConfig, maxAge time.Duration, keys ...[]byte) (*CookieStore, error) {
+	var s CookieStore
+	if maxAge < 5*time.Minute {
+		return nil, errors.New("maxAge duration too short")
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys given")
+	}
+
+	err := cookie.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		s.aeads = append(s.aeads, aead)
+	}
+
+	s.cookie = cookie
+	s.maxAge = maxAge
+
+	return &s, nil
+}
+
+/* Interface Functions */
+
+// Close the CookieStore, a NOP.
+func (s *CookieStore) Close() error {
+	return nil
+}
+
+// GC is a NOP, expired cookies are rejected when read.
+func (s *CookieStore) GC() error {
+	return nil
+}
+
+/*
+Get always fails, the session is in the request, see GetRequest.
+*/
+func (s *CookieStore) Get(sid string) (*Session, error) {
+	return nil, errors.New("CookieStore can only get sessions from a request")
+}
+
+/*
+GetRequest decrypts the session associated with sid from the request's
+cookies.
+*/
+func (s *CookieStore) GetRequest(req *http.Request, sid string) (*Session, error) {
+	sealed, _ := s.readChunks(req)
+	if sealed == "" {
+		return nil, ErrNotFound
+	}
+
+	payload, err := s.open(sealed)
+	if err != nil || payload.SID != sid || time.Now().Unix() > payload.Expires {
+		return nil, ErrNotFound
+	}
+
+	var ses Session
+	ses.sid = sid
+	ses.Values = payload.Values
+	ses.created = time.Unix(payload.Created, 0)
+	ses.lastUsed = time.Unix(payload.Used, 0)
+	ses.userID = payload.UserID
+	ses.version = payload.Commits
+	ses.lastIP = payload.LastIP
+	ses.userAgent = payload.Agent
+	ses.binding = payload.Binding
+	ses.flashes = payload.Flashes
+	if ses.Values == nil {
+		ses.Values = make(map[string]string)
+	}
+
+	return &ses, nil
+}
+
+// Commit session to the response's cookies.
+func (s *CookieStore) Commit(ses *Session) error {
+	if ses.w == nil {
+		return errors.New("CookieStore can only commit sessions with a response")
+	}
+	if responseWritten(ses.w) {
+		return errors.New("CookieStore can't commit after the response was written")
+	}
+
+	now := time.Now()
+	payload := cookiePayload{
+		SID:     ses.sid,
+		Values:  ses.Values,
+		Created: ses.created.Unix(),
+		Used:    now.Unix(),
+		Expires: s.expires(ses.created, now).Unix(),
+		UserID:  ses.userID,
+		Commits: ses.version + 1,
+		LastIP:  ses.lastIP,
+		Agent:   ses.userAgent,
+		Binding: ses.binding,
+		Flashes: ses.flashes,
+	}
+
+	sealed, err := s.seal(payload)
+	if err != nil {
+		return err
+	}
+
+	var chunks []string
+	for len(sealed) > cookieChunkSize {
+		chunks = append(chunks, sealed[:cookieChunkSize])
+		sealed = sealed[cookieChunkSize:]
+	}
+	chunks = append(chunks, sealed)
+
+	if len(chunks) > cookieMaxChunks {
+		return fmt.Errorf("session too large for cookies, needs %d chunks", len(chunks))
+	}
+
+	for i, chunk := range chunks {
+		http.SetCookie(ses.w, s.chunkCookie(i, chunk, ses.secure))
+	}
+
+	// Expire any left over chunks from a larger session.
+	if ses.req != nil {
+		_, existing := s.readChunks(ses.req)
+		s.expireChunks(ses.w, len(chunks), existing, ses.secure)
+	}
+
+	ses.version = payload.Commits
+	return nil
+}
+
+// Delete session by expiring its cookies.
+func (s *CookieStore) Delete(ses *Session) error {
+	if ses.w == nil || ses.req == nil {
+		return nil
+	}
+
+	_, existing := s.readChunks(ses.req)
+	s.expireChunks(ses.w, 0, existing, ses.secure)
+	return nil
+}
+
+/*
+SetMaxLifetime sets the absolute lifetime of sessions measured from their
+creation. Zero disables the limit. Normally set through
+SessionManager.SetMaxLifetime.
+*/
+func (s *CookieStore) SetMaxLifetime(lifetime time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maxLifetime = lifetime
+	return nil
+}
+
+/*
+SetIdleTimeout expires sessions unused for timeout, when shorter than maxAge.
+Zero leaves expiry to maxAge. Normally set through
+SessionManager.SetIdleTimeout.
+*/
+func (s *CookieStore) SetIdleTimeout(timeout time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.idleTimeout = timeout
+	return nil
+}
+
+// expires returns when a session committed now stops being valid.
+func (s *CookieStore) expires(created time.Time, now time.Time) time.Time {
+	s.RLock()
+	defer s.RUnlock()
+
+	expires := now.Add(s.maxAge)
+	if s.idleTimeout != 0 && s.idleTimeout < s.maxAge {
+		expires = now.Add(s.idleTimeout)
+	}
+	if s.maxLifetime != 0 {
+		absolute := created.Add(s.maxLifetime)
+		if absolute.Before(expires) {
+			expires = absolute
+		}
+	}
+	return expires
+}
+
+func (s *CookieStore) chunkName(i int) string {
+	return fmt.Sprintf("%s.%d", s.cookie.Name, i)
+}
+
+// chunkCookie returns chunk i holding value, secure is SessionManager.Secure as
+// for the session id cookie.
+func (s *CookieStore) chunkCookie(i int, value string, secure bool) *http.Cookie {
+	c := s.cookie.cookie(value, secure)
+	c.Name = s.chunkName(i)
+	return c
+}
+
+// readChunks returns the joined chunks present in req and how many there were.
+func (s *CookieStore) readChunks(req *http.Request) (string, int) {
+	var sealed strings.Builder
+
+	n := 0
+	for ; n < cookieMaxChunks; n++ {
+		c, err := req.Cookie(s.chunkName(n))
+		if err != nil {
+			break
+		}
+		sealed.WriteString(c.Value)
+	}
+
+	return sealed.String(), n
+}
+
+// expireChunks removes chunks from..to-1 from the client.
+func (s *CookieStore) expireChunks(w http.ResponseWriter, from int, to int, secure bool) {
+	for i := from; i < to; i++ {
+		c := s.chunkCookie(i, "", secure)
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+}
+
+// seal encrypts payload with the current key. The cookie name is used as
+// additional data so payloads can't be moved between stores.
+func (s *CookieStore) seal(payload cookiePayload) (string, error) {
+	plain, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plain, []byte(s.cookie.Name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a sealed payload trying each key in turn.
+func (s *CookieStore) open(encoded string) (cookiePayload, error) {
+	var payload cookiePayload
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return payload, err
+	}
+
+	for _, aead := range s.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+		plain, err := aead.Open(nil, nonce, ciphertext, []byte(s.cookie.Name))
+		if err != nil {
+			continue
+		}
+
+		err = json.Unmarshal(plain, &payload)
+		return payload, err
+	}
+
+	return payload, errors.New("unable to decrypt session cookie")
+}
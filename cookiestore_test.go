@@ -0,0 +1,177 @@
+package session
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_CookieStore(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	store, err := NewCookieStore(CookieConfig{Name: "test_data"}, 60*time.Minute, key)
+	if err != nil {
+		t.Fatalf("failed to create cookie store: %s", err)
+	}
+
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	memTest := SessionTestServer{t, sm}
+	srv := httptest.NewServer(sm.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		memTest.handle(w, req, FromContext(req.Context()))
+	})))
+	defer srv.Close()
+
+	sessionTest(t, srv.URL)
+
+	// The data cookies follow SessionManager.Secure like the id cookie.
+	sm.Secure = true
+	rec := httptest.NewRecorder()
+	ses, err := sm.Begin(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	ses.Set("user", "bob")
+	if err := ses.Commit(); err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if !c.Secure {
+			t.Errorf("cookie %s not Secure", c.Name)
+		}
+	}
+}
+
+func Test_CookieStoreChunksAndKeys(t *testing.T) {
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	newKey := bytes.Repeat([]byte("n"), 16)
+
+	store, err := NewCookieStore(CookieConfig{Name: "test_data"}, 60*time.Minute, oldKey)
+	if err != nil {
+		t.Fatalf("failed to create cookie store: %s", err)
+	}
+
+	big := strings.Repeat("x", 3*cookieChunkSize)
+
+	rec := httptest.NewRecorder()
+	ses := &Session{sid: "abc", sessionMeta: sessionMeta{created: time.Now()}, w: rec, req: httptest.NewRequest("GET", "/", nil)}
+	ses.Values = map[string]string{"big": big}
+	err = store.Commit(ses)
+	if err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) < 4 {
+		t.Fatalf("expected payload split over at least 4 cookies, got %d", len(cookies))
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	// Rotated keys still read the old cookies.
+	rotated, err := NewCookieStore(CookieConfig{Name: "test_data"}, 60*time.Minute, newKey, oldKey)
+	if err != nil {
+		t.Fatalf("failed to create cookie store: %s", err)
+	}
+	got, err := rotated.GetRequest(r, "abc")
+	if err != nil || got.Values["big"] != big {
+		t.Errorf("chunked session not read back: %v", err)
+	}
+
+	// Sessions are bound to their id and to the keys.
+	if _, err := rotated.GetRequest(r, "other"); err != ErrNotFound {
+		t.Errorf("session returned for the wrong sid: %v", err)
+	}
+	retired, _ := NewCookieStore(CookieConfig{Name: "test_data"}, 60*time.Minute, newKey)
+	if _, err := retired.GetRequest(r, "abc"); err != ErrNotFound {
+		t.Errorf("session decrypted without its key: %v", err)
+	}
+
+	// Shrinking the session expires the surplus chunks.
+	rec = httptest.NewRecorder()
+	ses = &Session{sid: "abc", sessionMeta: sessionMeta{created: time.Now()}, w: rec, req: r}
+	ses.Values = map[string]string{"small": "y"}
+	store.Commit(ses)
+
+	expired := 0
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			expired++
+		}
+	}
+	if expired != len(cookies)-1 {
+		t.Errorf("expected %d chunks expired, got %d", len(cookies)-1, expired)
+	}
+}
+
+func Test_CookieStoreLateChanges(t *testing.T) {
+	store, err := NewCookieStore(CookieConfig{Name: "test_data"}, 60*time.Minute, bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatalf("failed to create cookie store: %s", err)
+	}
+
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	// Changes after the response is started can't reach the cookie and must
+	// fail rather than vanish.
+	h := sm.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ses := FromContext(req.Context())
+		ses.Set("early", "yes")
+		w.WriteHeader(http.StatusOK)
+
+		if err := ses.Set("late", "yes"); err != ErrCommitted {
+			t.Errorf("Set after the response was written returned %v", err)
+		}
+		if err := ses.Commit(); err != ErrCommitted {
+			t.Errorf("second Commit returned %v", err)
+		}
+		if err := store.Commit(ses); err == nil {
+			t.Errorf("CookieStore committed after the response was written")
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	found := false
+	for _, c := range rec.Result().Cookies() {
+		found = found || strings.HasPrefix(c.Name, "test_data")
+	}
+	if !found {
+		t.Errorf("session committed before the response not sent")
+	}
+}
+
+func Test_CookieStoreIdleTimeout(t *testing.T) {
+	store, err := NewCookieStore(CookieConfig{Name: "test_data"}, 60*time.Minute, bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatalf("failed to create cookie store: %s", err)
+	}
+
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	// The manager's idle timeout shortens the cookies' expiry.
+	if err := sm.SetIdleTimeout(10 * time.Minute); err != nil {
+		t.Fatalf("SetIdleTimeout failed: %s", err)
+	}
+	now := time.Now()
+	if expires := store.expires(now, now); expires.Sub(now) != 10*time.Minute {
+		t.Errorf("cookie expires after %s expected the idle timeout", expires.Sub(now))
+	}
+}
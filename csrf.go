@@ -0,0 +1,114 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// csrfHeader is the request header CanAct accepts the action token from.
+const csrfHeader = "X-CSRF-Token"
+
+/*
+CSRFMiddleware rejects requests with unsafe methods, anything other than GET,
+HEAD, OPTIONS and TRACE, unless the session's CanAct accepts them. Rejected
+requests are answered with a 403 and next is not called.
+
+Must be wrapped by Middleware or ReadOnlyMiddleware, which supply the session:
+
+	sm.Middleware(sm.CSRFMiddleware(handler))
+
+The token is not rotated, so pages open in several tabs keep working. Use
+MaskedActionToken in pages sent over compressed connections.
+*/
+func (sm *SessionManager) CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !safeMethod(req.Method) {
+			ses := FromContext(req.Context())
+			if ses == nil || !ses.CanAct() {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// safeMethod reports whether method must not change state, so needs no token.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+/*
+MaskedActionToken returns ActionToken XORed with a fresh random pad, so it
+differs on every call. Pages embedding it give compression based attacks such
+as BREACH no repeated secret to recover. CanAct accepts both forms.
+*/
+func (s *Session) MaskedActionToken() string {
+	token := s.ActionToken()
+	if token == "error" {
+		return token
+	}
+
+	pad, err := randomBytes(len(token))
+	if err != nil {
+		return "error"
+	}
+
+	masked := make([]byte, 2*len(token))
+	copy(masked, pad)
+	for i := range pad {
+		masked[len(token)+i] = token[i] ^ pad[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(masked)
+}
+
+// unmaskToken reverses MaskedActionToken, returning "" for malformed input.
+func unmaskToken(masked string) string {
+	b, err := base64.RawURLEncoding.DecodeString(masked)
+	if err != nil || len(b) == 0 || len(b)%2 != 0 {
+		return ""
+	}
+
+	n := len(b) / 2
+	token := make([]byte, n)
+	for i := range token {
+		token[i] = b[i] ^ b[n+i]
+	}
+	return string(token)
+}
+
+// requestToken returns the action token sent with the request.
+func (s *Session) requestToken() string {
+	if s.req == nil {
+		return ""
+	}
+
+	if token := s.req.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+	return s.req.FormValue("actionToken")
+}
+
+// validToken checks token, plain or masked, against the session's action
+// token in constant time.
+func (s *Session) validToken(token string) bool {
+	if s.sm.derivedTokens() {
+		return s.validDerivedToken(token, "", s.requestPath())
+	}
+
+	sat := s.Get("actionToken")
+	if sat == "" || token == "" {
+		return false
+	}
+
+	if len(token) != len(sat) {
+		token = unmaskToken(token)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(sat)) == 1
+}
@@ -0,0 +1,82 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_CSRFMiddleware(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	h := sm.Middleware(sm.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ses := FromContext(req.Context())
+		fmt.Fprintf(w, "%s %s", ses.ActionToken(), ses.MaskedActionToken())
+	})))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusOK || len(cookies) == 0 {
+		t.Fatalf("GET without a token refused")
+	}
+
+	var token, masked string
+	fmt.Sscan(rec.Body.String(), &token, &masked)
+	if masked == token || unmaskToken(masked) != token {
+		t.Fatalf("masked token '%s' doesn't unmask to '%s'", masked, token)
+	}
+
+	serve := func(method string, form url.Values, header string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			r.Header.Set("X-CSRF-Token", header)
+		}
+		r.AddCookie(cookies[0])
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	tests := []struct {
+		method string
+		form   url.Values
+		header string
+		code   int
+	}{
+		{"POST", nil, "", http.StatusForbidden},
+		{"DELETE", nil, "error", http.StatusForbidden},
+		{"PUT", nil, token[1:] + "0", http.StatusForbidden},
+		{"PATCH", url.Values{"actionToken": {masked[:len(masked)-2]}}, "", http.StatusForbidden},
+		{"POST", url.Values{"actionToken": {token}}, "", http.StatusOK},
+		{"POST", url.Values{"actionToken": {masked}}, "", http.StatusOK},
+		{"PUT", nil, token, http.StatusOK},
+		{"DELETE", nil, masked, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := serve(tt.method, tt.form, tt.header); code != tt.code {
+			t.Errorf("%s with form %v header '%s' got %d, expected %d", tt.method, tt.form, tt.header, code, tt.code)
+		}
+	}
+
+	// Without a session nothing unsafe gets through.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST from a new client got %d, expected 403", rec.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+)
+
+/*
+SessionLocker is an optional interface for SessionStorage providing a lock on
+a session id that is shared by every process using the same storage, see
+SetDistributedLocking.
+*/
+type SessionLocker interface {
+	/*
+		Block until the lock on sid is held or ctx is done. Locks must not
+		outlive the process holding them.
+	*/
+	LockSession(ctx context.Context, sid string) error
+
+	/*
+		Release the lock on sid. NOP if it isn't held.
+	*/
+	UnlockSession(sid string) error
+}
+
+/*
+SetDistributedLocking makes Begin hold the storage's lock on the session, in
+addition to the in process lock, until Commit. Needed when several servers
+share a storage, so that requests for the same session arriving at different
+servers don't overwrite each other's changes.
+
+Requires the storage to implement SessionLocker. Has no effect in optimistic
+mode, which needs no locks.
+*/
+func (sm *SessionManager) SetDistributedLocking(enabled bool) error {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if _, ok := sm.storage.(SessionLocker); enabled && !ok {
+		return ErrNotSupported
+	}
+
+	sm.distributed = enabled
+	return nil
+}
+
+// lockShared takes the storage's lock on sid once the in process lock is
+// held. On failure the in process lock is released.
+func (sm *SessionManager) lockShared(ctx context.Context, sid string, lock *sidLock) error {
+	sm.RLock()
+	distributed := sm.distributed
+	lockTimeout := sm.lockTimeout
+	sm.RUnlock()
+
+	if !distributed {
+		return nil
+	}
+
+	waitCtx := ctx
+	if lockTimeout != 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, lockTimeout)
+		defer cancel()
+	}
+
+	err := sm.storage.(SessionLocker).LockSession(waitCtx, sid)
+	if err != nil {
+		sm.unlockSID(sid, lock)
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			return ErrLockTimeout
+		}
+		return err
+	}
+
+	sm.Lock()
+	lock.shared = true
+	sm.Unlock()
+	return nil
+}
+
+// unlockShared releases the storage's lock on sid, failures are only logged
+// as the lock will be lost with the process anyway.
+func (sm *SessionManager) unlockShared(sid string) {
+	err := sm.storage.(SessionLocker).UnlockSession(sid)
+	if err != nil {
+		sm.logf("session: failed to release distributed session lock: %s", err)
+	}
+}
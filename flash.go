@@ -0,0 +1,137 @@
+package session
+
+import "encoding/json"
+
+/*
+Flash is a one-shot message, typically set before a redirect and displayed on
+the page that follows it.
+*/
+type Flash struct {
+	Category string `json:"c"`
+	Message  string `json:"m"`
+}
+
+/*
+Flashes are kept with the session's metadata rather than in Values. Messages
+added during a request are available to it and the next request using the
+session, and are dropped unread once that request commits. Read only requests
+can't drop them, so they are left for the next request using Begin.
+*/
+
+/*
+AddFlash queues a message under category for this and the next request. Fails
+as Set does.
+*/
+func (s *Session) AddFlash(category string, message string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	s.materialize()
+	s.queued = append(s.queued, Flash{Category: category, Message: message})
+	return nil
+}
+
+/*
+Flashes returns the available messages in the order they were added and
+removes them from the session. If any categories are given only messages in
+those categories are returned and removed, the rest are left for later. Read
+only and committed sessions can't remove messages, for them Flashes is
+PeekFlashes.
+*/
+func (s *Session) Flashes(categories ...string) []Flash {
+	s.Lock()
+	if s.checkWritable() != nil {
+		s.Unlock()
+		return s.PeekFlashes(categories...)
+	}
+	defer s.Unlock()
+
+	var found []Flash
+	s.shown, found = takeFlashes(s.shown, found, categories)
+	s.queued, found = takeFlashes(s.queued, found, categories)
+	return found
+}
+
+/*
+PeekFlashes returns the same messages as Flashes but leaves them in the
+session.
+*/
+func (s *Session) PeekFlashes(categories ...string) []Flash {
+	s.RLock()
+	defer s.RUnlock()
+
+	var found []Flash
+	for _, flashes := range [][]Flash{s.shown, s.queued} {
+		for _, f := range flashes {
+			if inCategories(f.Category, categories) {
+				found = append(found, f)
+			}
+		}
+	}
+	return found
+}
+
+// takeFlashes moves the flashes in categories to found, returning the rest.
+func takeFlashes(flashes []Flash, found []Flash, categories []string) ([]Flash, []Flash) {
+	var kept []Flash
+	for _, f := range flashes {
+		if inCategories(f.Category, categories) {
+			found = append(found, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	return kept, found
+}
+
+// loadFlashes makes the flashes queued by the previous request available to
+// this one. Undecodable flashes are logged and dropped.
+func (s *Session) loadFlashes() {
+	s.shown = nil
+	s.queued = nil
+	if s.flashes == "" {
+		return
+	}
+
+	err := json.Unmarshal([]byte(s.flashes), &s.shown)
+	if err != nil {
+		s.sm.logf("session: dropping undecodable flashes: %s", err)
+		s.shown = nil
+	}
+}
+
+// storeFlashes records the flashes left for the next request in the metadata,
+// dropping those shown to this one. The session must be locked.
+func (s *Session) storeFlashes() error {
+	var encoded string
+	if len(s.queued) > 0 {
+		b, err := json.Marshal(s.queued)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+
+	if encoded != s.flashes {
+		s.flashes = encoded
+		s.metaChanged = true
+	}
+	return nil
+}
+
+func inCategories(category string, categories []string) bool {
+	if len(categories) == 0 {
+		return true
+	}
+
+	for _, c := range categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
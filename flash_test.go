@@ -0,0 +1,74 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_FlashCategories(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+
+	ses.AddFlash("error", "bad")
+	ses.AddFlash("info", "good")
+	ses.AddFlash("error", "worse")
+
+	if f := ses.PeekFlashes(); len(f) != 3 {
+		t.Errorf("PeekFlashes returned %d flashes, expected 3", len(f))
+	}
+
+	errs := ses.Flashes("error")
+	if len(errs) != 2 || errs[0].Message != "bad" || errs[1].Message != "worse" {
+		t.Errorf("Flashes(error) returned %+v", errs)
+	}
+
+	rest := ses.Flashes()
+	if len(rest) != 1 || rest[0].Category != "info" {
+		t.Errorf("Flashes() returned %+v, expected only the info flash", rest)
+	}
+
+	if f := ses.PeekFlashes(); len(f) != 0 {
+		t.Errorf("flashes still queued after being read: %+v", f)
+	}
+}
+
+func Test_FlashExpiry(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+
+	ses.Set("flashes", "app data")
+	values := len(ses.Values)
+	ses.AddFlash("info", "saved")
+	if len(ses.Values) != values {
+		t.Errorf("flashes stored in Values: %v", ses.Values)
+	}
+	ses.Commit()
+
+	resume := func() *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: ses.sid})
+		ses, err := sm.Begin(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("failed to resume session: %s", err)
+		}
+		return ses
+	}
+
+	// The next request sees the flash, but doesn't read it.
+	ses = resume()
+	if f := ses.PeekFlashes(); len(f) != 1 || f[0].Message != "saved" {
+		t.Errorf("flash not available to the next request: %+v", f)
+	}
+	if ses.Get("flashes") != "app data" {
+		t.Errorf("flashes clobbered the app's value '%s'", ses.Get("flashes"))
+	}
+	ses.Commit()
+
+	// After which it's gone.
+	ses = resume()
+	if f := ses.Flashes(); len(f) != 0 {
+		t.Errorf("flash survived a second request: %+v", f)
+	}
+	ses.Commit()
+}
@@ -0,0 +1,178 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+IDGenerator creates new session ids, see SetIDGenerator.
+
+Ids must be unpredictable and unique. They are sent to clients as cookie or
+header values, so must be printable ASCII without spaces, quotes, commas,
+semicolons or backslashes, and MySQLStore stores up to 128 characters.
+*/
+type IDGenerator interface {
+	/*
+		Return a new session id. An error fails the operation needing the
+		id, it must never be papered over with a weak id.
+	*/
+	NewID() (string, error)
+}
+
+// IDGeneratorFunc adapts a function to an IDGenerator.
+type IDGeneratorFunc func() (string, error)
+
+// NewID calls f.
+func (f IDGeneratorFunc) NewID() (string, error) {
+	return f()
+}
+
+// idBytes is the amount of randomness in generated ids.
+const idBytes = 32
+
+// randReader is the source of randomness for ids and action tokens.
+var randReader io.Reader = rand.Reader
+
+// randomBytes returns n bytes from randReader.
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(randReader, buf)
+	if err != nil {
+		return nil, fmt.Errorf("reading random bytes: %w", err)
+	}
+	return buf, nil
+}
+
+/*
+HexIDs returns the default IDGenerator, 32 random bytes from crypto/rand hex
+encoded.
+*/
+func HexIDs() IDGenerator {
+	return IDGeneratorFunc(func() (string, error) {
+		buf, err := randomBytes(idBytes)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(buf), nil
+	})
+}
+
+/*
+Base64IDs returns an IDGenerator of 32 random bytes from crypto/rand encoded
+as unpadded base64url, shorter than HexIDs for the same strength.
+*/
+func Base64IDs() IDGenerator {
+	return IDGeneratorFunc(func() (string, error) {
+		buf, err := randomBytes(idBytes)
+		if err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(buf), nil
+	})
+}
+
+/*
+PrefixedIDs returns an IDGenerator adding prefix to the ids of gen, making
+them recognisable in logs and secret scanners.
+*/
+func PrefixedIDs(prefix string, gen IDGenerator) IDGenerator {
+	return IDGeneratorFunc(func() (string, error) {
+		id, err := gen.NewID()
+		if err != nil {
+			return "", err
+		}
+		return prefix + id, nil
+	})
+}
+
+/*
+ShardedIDs returns an IDGenerator tagging the ids of gen with shard, so that
+load balancers and storage can route a session using IDShard. Returns an error
+if shard is empty, contains "." or can't be used in a cookie.
+*/
+func ShardedIDs(shard string, gen IDGenerator) (IDGenerator, error) {
+	if !validID(shard) || strings.Contains(shard, ".") {
+		return nil, fmt.Errorf("invalid id shard %q", shard)
+	}
+
+	return IDGeneratorFunc(func() (string, error) {
+		id, err := gen.NewID()
+		if err != nil {
+			return "", err
+		}
+		return shard + "." + id, nil
+	}), nil
+}
+
+/*
+IDShard returns the shard of a session id made by ShardedIDs, or "" if it has
+none. Works on both bare and signed ids.
+*/
+func IDShard(sid string) string {
+	shard, _, ok := strings.Cut(sid, ".")
+	if !ok {
+		return ""
+	}
+	return shard
+}
+
+/*
+SetIDGenerator sets how new session ids are created, HexIDs by default.
+*/
+func (sm *SessionManager) SetIDGenerator(gen IDGenerator) error {
+	if gen == nil {
+		return errors.New("nil IDGenerator")
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.idGenerator = gen
+	return nil
+}
+
+// newID returns a new session id from the IDGenerator.
+func (sm *SessionManager) newID() (string, error) {
+	sm.RLock()
+	gen := sm.idGenerator
+	sm.RUnlock()
+
+	id, err := gen.NewID()
+	if err != nil {
+		return "", fmt.Errorf("session: failed to generate id: %w", err)
+	}
+	if !validID(id) {
+		return "", fmt.Errorf("session: generated invalid id %q", id)
+	}
+	return id, nil
+}
+
+// validID checks id can be sent as a cookie or header value unchanged.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// newToken returns a random action token.
+func newToken() (string, error) {
+	buf, err := randomBytes(idBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
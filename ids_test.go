@@ -0,0 +1,108 @@
+package session
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// failingReader stands in for an exhausted entropy source.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func Test_IDGenerators(t *testing.T) {
+	sharded, err := ShardedIDs("eu1", HexIDs())
+	if err != nil {
+		t.Fatalf("ShardedIDs failed: %s", err)
+	}
+
+	generators := []struct {
+		gen     IDGenerator
+		pattern string
+	}{
+		{HexIDs(), "^[0-9a-f]{64}$"},
+		{Base64IDs(), "^[A-Za-z0-9_-]{43}$"},
+		{PrefixedIDs("ses_", Base64IDs()), "^ses_[A-Za-z0-9_-]{43}$"},
+		{sharded, `^eu1\.[0-9a-f]{64}$`},
+	}
+
+	for _, g := range generators {
+		a, errA := g.gen.NewID()
+		b, errB := g.gen.NewID()
+		if errA != nil || errB != nil {
+			t.Fatalf("NewID failed: %v, %v", errA, errB)
+		}
+		if !regexp.MustCompile(g.pattern).MatchString(a) || a == b {
+			t.Errorf("generated '%s' and '%s', expected distinct ids matching %s", a, b, g.pattern)
+		}
+	}
+
+	if shard := IDShard("eu1.abc.signature"); shard != "eu1" {
+		t.Errorf("IDShard returned '%s', expected 'eu1'", shard)
+	}
+	for _, shard := range []string{"", "a.b", "a b"} {
+		if _, err := ShardedIDs(shard, HexIDs()); err == nil {
+			t.Errorf("invalid shard '%s' accepted", shard)
+		}
+	}
+
+	// Generated ids are used by the manager.
+	sm, _ := newTestSession(t)
+	defer sm.Close()
+	sm.SetIDGenerator(PrefixedIDs("ses_", HexIDs()))
+	_, ses := newTestSessionFor(t, sm)
+	if !strings.HasPrefix(ses.sid, "ses_") {
+		t.Errorf("session id '%s' not from the IDGenerator", ses.sid)
+	}
+	ses.Commit()
+
+	bad := IDGeneratorFunc(func() (string, error) { return "has space", nil })
+	sm.SetIDGenerator(bad)
+	if _, err := sm.Begin(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("invalid generated id accepted")
+	}
+}
+
+func Test_IDGeneratorFailure(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+
+	ses.Set("user", "bob")
+	sid := ses.sid
+
+	randReader = failingReader{}
+	defer func() { randReader = rand.Reader }()
+
+	// Failures leave the session as it was.
+	if err := ses.Regenerate(); err == nil || ses.sid != sid {
+		t.Errorf("Regenerate without entropy returned %v and moved to '%s'", err, ses.sid)
+	}
+	if err := ses.Clear(); err == nil || ses.Get("user") != "bob" {
+		t.Errorf("Clear without entropy returned %v", err)
+	}
+	if token := ses.NewActionToken(); token != "error" || ses.ActionToken() != "error" {
+		t.Errorf("NewActionToken without entropy returned '%s'", token)
+	}
+	ses.Commit()
+
+	if _, err := sm.Begin(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("Begin without entropy created a session")
+	}
+
+	// Lazy sessions fail at Commit, Set has no error to return.
+	sm.Lazy = true
+	lazy, err := sm.Begin(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("Begin of a lazy session failed: %s", err)
+	}
+	lazy.Set("user", "alice")
+	if err := lazy.Commit(); err == nil {
+		t.Errorf("Commit of a lazy session without an id succeeded")
+	}
+}
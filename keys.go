@@ -0,0 +1,69 @@
+package session
+
+import "fmt"
+
+/*
+Key declares a session variable name together with the type of its value, so
+that packages sharing a session can't collide on names or disagree about what
+is stored under them.
+
+	var cartKey = session.NewKey[Cart]("cart")
+
+	cart, ok := cartKey.Get(ses)
+
+Values are stored in Session.Values using the same encodings as the typed
+accessors, so a Key[int] and GetInt interoperate.
+*/
+type Key[T any] struct {
+	name string
+}
+
+/*
+NewKey returns a Key for the session variable name.
+*/
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name returns the session variable name used by the key.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+/*
+Get returns the value stored under the key. The bool is false if no value is
+stored or the stored value can not be decoded as a T.
+*/
+func (k Key[T]) Get(s *Session) (T, bool) {
+	var value T
+
+	stored, err := s.lookup(k.name)
+	if err != nil {
+		return value, false
+	}
+
+	err = decodeValue(stored, &value)
+	if err != nil {
+		var zero T
+		return zero, false
+	}
+	return value, true
+}
+
+/*
+Set stores value under the key. Returns an error if value can not be encoded
+or the session can't be changed.
+*/
+func (k Key[T]) Set(s *Session, value T) error {
+	stored, err := encodeValue(value)
+	if err != nil {
+		return fmt.Errorf("session value %q: %s", k.name, err)
+	}
+
+	return s.Set(k.name, stored)
+}
+
+// Delete removes the key's value from the session.
+func (k Key[T]) Delete(s *Session) error {
+	return s.Delete(k.name)
+}
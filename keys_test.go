@@ -0,0 +1,54 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Key(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+
+	countKey := NewKey[int]("count")
+	nameKey := NewKey[string]("name")
+	cartKey := NewKey[testCart]("cart")
+	seenKey := NewKey[time.Time]("seen")
+
+	if _, ok := countKey.Get(ses); ok {
+		t.Errorf("Get on unset key reported ok")
+	}
+
+	countKey.Set(ses, 7)
+	nameKey.Set(ses, "bob")
+	seenKey.Set(ses, time.Unix(1000, 0))
+	err := cartKey.Set(ses, testCart{Items: []string{"x"}, Total: 1})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if v, ok := countKey.Get(ses); !ok || v != 7 {
+		t.Errorf("count got %d, %t expected 7", v, ok)
+	}
+	if i, err := ses.GetInt("count"); err != nil || i != 7 {
+		t.Errorf("GetInt on Key[int] value got %d, %v", i, err)
+	}
+	if v := ses.Get("name"); v != "bob" {
+		t.Errorf("Get on Key[string] value got '%s' expected 'bob'", v)
+	}
+	if v, ok := seenKey.Get(ses); !ok || !v.Equal(time.Unix(1000, 0)) {
+		t.Errorf("seen got %s, %t", v, ok)
+	}
+	if v, ok := cartKey.Get(ses); !ok || v.Total != 1 {
+		t.Errorf("cart got %+v, %t", v, ok)
+	}
+
+	// Mismatched type for the same name.
+	if _, ok := NewKey[int]("name").Get(ses); ok {
+		t.Errorf("Key[int] decoded a string value")
+	}
+
+	countKey.Delete(ses)
+	if _, ok := countKey.Get(ses); ok {
+		t.Errorf("Get after Delete reported ok")
+	}
+}
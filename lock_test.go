@@ -0,0 +1,213 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_LockTimeout(t *testing.T) {
+	sm, held := newTestSession(t)
+	defer sm.Close()
+
+	begin := func(ctx context.Context) (*Session, error) {
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: held.sid})
+		return sm.Begin(httptest.NewRecorder(), r)
+	}
+
+	// The request context bounds the wait.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := begin(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Begin on a held session returned %v, expected the context's error", err)
+	}
+
+	// As does the lock timeout.
+	sm.SetLockTimeout(50 * time.Millisecond)
+	if _, err := begin(context.Background()); err != ErrLockTimeout {
+		t.Errorf("Begin on a held session returned %v, expected ErrLockTimeout", err)
+	}
+
+	// Once released the session is available again.
+	held.Commit()
+	ses, err := begin(context.Background())
+	if err != nil || ses.sid != held.sid {
+		t.Errorf("Begin after commit failed: %v", err)
+	}
+	ses.Commit()
+}
+
+func Test_LockReclaim(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+	ses.Commit()
+
+	var logged bytes.Buffer
+	sm.ErrorLog = log.New(&logged, "", 0)
+	sm.SetMaxLockHold(time.Second)
+
+	resume := func() *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: ses.sid})
+		ses, err := sm.Begin(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Begin failed: %s", err)
+		}
+		return ses
+	}
+
+	// abandoned doesn't commit in time, a later request takes its lock after
+	// the maximum hold.
+	abandoned := resume()
+	begin := time.Now()
+	ses = resume()
+	if ses.sid != abandoned.sid {
+		t.Fatalf("session not resumed after reclaiming its lock")
+	}
+	if time.Since(begin) < 900*time.Millisecond {
+		t.Errorf("lock reclaimed after only %s", time.Since(begin))
+	}
+	if !strings.Contains(logged.String(), "reclaimed") {
+		t.Errorf("lock reclaim not logged, got '%s'", logged.String())
+	}
+
+	// The late commit of the original holder must neither free the new lock
+	// nor overwrite the new holder's values.
+	ses.Set("user", "carol")
+	abandoned.Set("user", "mallory")
+	if err := abandoned.Commit(); err != ErrLockTimeout {
+		t.Errorf("commit after reclaim returned %v expected ErrLockTimeout", err)
+	}
+	sm.Lock()
+	lock := sm.activeSessions[ses.sid]
+	sm.Unlock()
+	if lock == nil || lock != ses.lock {
+		t.Errorf("reclaimed lock released by its previous holder")
+	}
+	ses.Commit()
+
+	ses = resume()
+	if ses.Get("user") != "carol" {
+		t.Errorf("reclaimed holder's value overwritten, got '%s'", ses.Get("user"))
+	}
+	ses.Commit()
+}
+
+// sharedLockStore adds a SessionLocker to MemoryStore, standing in for a store
+// shared by several servers.
+type sharedLockStore struct {
+	*MemoryStore
+
+	mu    sync.Mutex
+	held  map[string]chan bool
+	locks int
+}
+
+func (s *sharedLockStore) LockSession(ctx context.Context, sid string) error {
+	for {
+		s.mu.Lock()
+		released, held := s.held[sid]
+		if !held {
+			s.held[sid] = make(chan bool)
+			s.locks++
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *sharedLockStore) UnlockSession(sid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if released, held := s.held[sid]; held {
+		close(released)
+		delete(s.held, sid)
+	}
+	return nil
+}
+
+// secondServerStore is another server's view of a sharedLockStore, leaving
+// closing it to the first.
+type secondServerStore struct {
+	*sharedLockStore
+}
+
+func (s secondServerStore) Close() error {
+	return nil
+}
+
+func Test_DistributedLocking(t *testing.T) {
+	mem, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	store := &sharedLockStore{MemoryStore: mem, held: make(map[string]chan bool)}
+
+	// Plain stores can't lock across servers.
+	sm, _ := newTestSession(t)
+	defer sm.Close()
+	if err := sm.SetDistributedLocking(true); err != ErrNotSupported {
+		t.Errorf("SetDistributedLocking without a SessionLocker returned %v", err)
+	}
+
+	// Two servers sharing one store.
+	var servers [2]*SessionManager
+	for i, s := range []SessionStorage{store, secondServerStore{store}} {
+		servers[i], err = NewSessionManager(s, "test_session")
+		if err != nil {
+			t.Fatalf("failed to create session manager: %s", err)
+		}
+		if err := servers[i].SetDistributedLocking(true); err != nil {
+			t.Fatalf("SetDistributedLocking failed: %s", err)
+		}
+		servers[i].SetLockTimeout(50 * time.Millisecond)
+	}
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	_, ses := newTestSessionFor(t, servers[0])
+	ses.Commit()
+
+	begin := func(sm *SessionManager) (*Session, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: ses.sid})
+		return sm.Begin(httptest.NewRecorder(), r)
+	}
+
+	held, err := begin(servers[0])
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	if _, err := begin(servers[1]); err != ErrLockTimeout {
+		t.Errorf("Begin on a session held by another server returned %v, expected ErrLockTimeout", err)
+	}
+
+	// The failed attempt must not leave the in process lock behind.
+	held.Commit()
+	ses, err = begin(servers[1])
+	if err != nil {
+		t.Fatalf("Begin after the other server committed failed: %s", err)
+	}
+	ses.Commit()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.held) != 0 || store.locks != 2 {
+		t.Errorf("expected 2 locks all released, took %d with %d still held", store.locks, len(store.held))
+	}
+}
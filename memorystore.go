@@ -1,13 +1,21 @@
 package session
 
 import (
+	"context"
 	"errors"
 	"time"
 )
 
 type storedSession struct {
 	sid      string
+	created  time.Time
 	lastUsed time.Time
+	version  uint64
+	userID   string
+	lastIP   string
+	ua       string
+	binding  string
+	flashes  string
 	values   map[string]string
 }
 
@@ -17,21 +25,39 @@ for testing and small scale uses.
 */
 type MemoryStore struct {
 	commitQueue chan memReq
+	casQueue    chan memReq
 	deleteQueue chan memReq
 	gcQueue     chan memReq
 	getQueue    chan memReq
+	touchQueue  chan memReq
+	listQueue   chan memReq
+	countQueue  chan memReq
+	userQueue   chan memReq
 
-	closeChan chan memReq
+	lifetimeQueue chan memReq
+	idleQueue     chan memReq
+	closeChan     chan memReq
 
 	store map[string]storedSession
 
-	maxAge time.Duration
+	// users indexes session ids by user id.
+	users map[string]map[string]bool
+
+	maxAge      time.Duration
+	maxLifetime time.Duration
+	idleTimeout time.Duration
 }
 
 type memReq struct {
-	sid     string
-	session *Session
-	err     error
+	sid      string
+	uid      string
+	session  *Session
+	lifetime time.Duration
+	idle     time.Duration
+	sids     []string
+	count    int
+	version  uint64
+	err      error
 
 	respChan chan memReq
 }
@@ -47,11 +73,19 @@ func NewMemoryStore(maxAge time.Duration) (*MemoryStore, error) {
 
 	s.getQueue = make(chan memReq, 10)
 	s.commitQueue = make(chan memReq, 10)
+	s.casQueue = make(chan memReq, 10)
 	s.gcQueue = make(chan memReq)
 	s.deleteQueue = make(chan memReq, 10)
+	s.touchQueue = make(chan memReq, 10)
+	s.listQueue = make(chan memReq)
+	s.countQueue = make(chan memReq)
+	s.userQueue = make(chan memReq)
+	s.lifetimeQueue = make(chan memReq)
+	s.idleQueue = make(chan memReq)
 	s.closeChan = make(chan memReq)
 
 	s.store = make(map[string]storedSession)
+	s.users = make(map[string]map[string]bool)
 
 	s.maxAge = maxAge
 
@@ -87,34 +121,153 @@ func (s *MemoryStore) GC() error {
 
 // Get session associated with sid.
 func (s *MemoryStore) Get(sid string) (*Session, error) {
+	return s.GetContext(context.Background(), sid)
+}
+
+// GetContext gets the session associated with sid unless ctx is done first.
+func (s *MemoryStore) GetContext(ctx context.Context, sid string) (*Session, error) {
+	resp := s.request(ctx, s.getQueue, memReq{sid: sid})
+	return resp.session, resp.err
+}
+
+// Commit session back to storage.
+func (s *MemoryStore) Commit(ses *Session) error {
+	return s.CommitContext(context.Background(), ses)
+}
+
+/*
+CommitContext commits the session unless ctx is done first. A commit already
+handed to the store when ctx is done still completes.
+*/
+func (s *MemoryStore) CommitContext(ctx context.Context, ses *Session) error {
+	resp := s.request(ctx, s.commitQueue, memReq{session: ses})
+	if resp.err == nil {
+		ses.version = resp.version
+	}
+	return resp.err
+}
+
+/*
+CommitVersion commits the session only if its version matches the stored
+session, otherwise returns ErrConflict.
+*/
+func (s *MemoryStore) CommitVersion(ctx context.Context, ses *Session) error {
+	resp := s.request(ctx, s.casQueue, memReq{session: ses, version: ses.version})
+	if resp.err == nil {
+		ses.version = resp.version
+	}
+	return resp.err
+}
+
+// Touch updates the session's last used time.
+func (s *MemoryStore) Touch(ses *Session) error {
+	return s.TouchContext(context.Background(), ses)
+}
+
+// TouchContext touches the session unless ctx is done first.
+func (s *MemoryStore) TouchContext(ctx context.Context, ses *Session) error {
+	return s.request(ctx, s.touchQueue, memReq{session: ses}).err
+}
+
+// List the ids of all unexpired sessions.
+func (s *MemoryStore) List() ([]string, error) {
 	respChan := make(chan memReq)
-	req := memReq{sid: sid, respChan: respChan}
+	req := memReq{respChan: respChan}
 
-	s.getQueue <- req
+	s.listQueue <- req
 	resp := <-respChan
 
 	close(respChan)
-	return resp.session, resp.err
+	return resp.sids, resp.err
 }
 
-// Commit session back to storage.
-func (s *MemoryStore) Commit(ses *Session) error {
+// Count the unexpired sessions.
+func (s *MemoryStore) Count() (int, error) {
 	respChan := make(chan memReq)
-	req := memReq{session: ses, respChan: respChan}
+	req := memReq{respChan: respChan}
 
-	s.commitQueue <- req
+	s.countQueue <- req
 	resp := <-respChan
 
 	close(respChan)
-	return resp.err
+	return resp.count, resp.err
+}
+
+// SessionsForUser returns the ids of the unexpired sessions of uid.
+func (s *MemoryStore) SessionsForUser(uid string) ([]string, error) {
+	respChan := make(chan memReq)
+	req := memReq{uid: uid, respChan: respChan}
+
+	s.userQueue <- req
+	resp := <-respChan
+
+	close(respChan)
+	return resp.sids, resp.err
 }
 
 // Delete session from storage.
 func (s *MemoryStore) Delete(ses *Session) error {
+	return s.DeleteContext(context.Background(), ses)
+}
+
+// DeleteContext deletes the session unless ctx is done first.
+func (s *MemoryStore) DeleteContext(ctx context.Context, ses *Session) error {
+	return s.request(ctx, s.deleteQueue, memReq{session: ses}).err
+}
+
+/*
+request queues req and waits for the response, giving up when ctx is done. The
+response channel is buffered so serve never blocks on an abandoned request.
+*/
+func (s *MemoryStore) request(ctx context.Context, queue chan memReq, req memReq) memReq {
+	if err := ctx.Err(); err != nil {
+		req.err = err
+		return req
+	}
+	req.respChan = make(chan memReq, 1)
+
+	select {
+	case queue <- req:
+	case <-ctx.Done():
+		req.err = ctx.Err()
+		return req
+	}
+
+	select {
+	case resp := <-req.respChan:
+		return resp
+	case <-ctx.Done():
+		req.err = ctx.Err()
+		return req
+	}
+}
+
+/*
+SetMaxLifetime sets the absolute lifetime of sessions measured from their
+creation. Zero disables the limit. Normally set through
+SessionManager.SetMaxLifetime.
+*/
+func (s *MemoryStore) SetMaxLifetime(lifetime time.Duration) error {
+	respChan := make(chan memReq)
+	req := memReq{lifetime: lifetime, respChan: respChan}
+
+	s.lifetimeQueue <- req
+	resp := <-respChan
+
+	close(respChan)
+	return resp.err
+}
+
+/*
+SetIdleTimeout expires sessions unused for timeout, when shorter than maxAge.
+Zero leaves expiry to maxAge. Normally set through
+SessionManager.SetIdleTimeout.
+*/
+func (s *MemoryStore) SetIdleTimeout(timeout time.Duration) error {
 	respChan := make(chan memReq)
-	req := memReq{session: ses, respChan: respChan}
+	req := memReq{idle: timeout, respChan: respChan}
 
-	s.deleteQueue <- req
+	s.idleQueue <- req
 	resp := <-respChan
 
 	close(respChan)
@@ -126,13 +279,33 @@ func (s *MemoryStore) serve() {
 	for {
 		select {
 		case req := <-s.commitQueue:
-			req.err = s.commit(req.session)
+			req.version, req.err = s.commit(req.session)
+			req.respChan <- req
+
+		case req := <-s.casQueue:
+			req.version, req.err = s.commitVersion(req.session, req.version)
 			req.respChan <- req
 
 		case req := <-s.deleteQueue:
 			req.err = s.delete(req.session)
 			req.respChan <- req
 
+		case req := <-s.touchQueue:
+			req.err = s.touch(req.session)
+			req.respChan <- req
+
+		case req := <-s.listQueue:
+			req.sids, req.err = s.list()
+			req.respChan <- req
+
+		case req := <-s.countQueue:
+			req.count, req.err = s.count()
+			req.respChan <- req
+
+		case req := <-s.userQueue:
+			req.sids, req.err = s.sessionsForUser(req.uid)
+			req.respChan <- req
+
 		case req := <-s.gcQueue:
 			req.err = s.gc()
 			req.respChan <- req
@@ -141,6 +314,14 @@ func (s *MemoryStore) serve() {
 			req.session, req.err = s.get(req.sid)
 			req.respChan <- req
 
+		case req := <-s.lifetimeQueue:
+			s.maxLifetime = req.lifetime
+			req.respChan <- req
+
+		case req := <-s.idleQueue:
+			s.idleTimeout = req.idle
+			req.respChan <- req
+
 		case req := <-s.closeChan:
 			req.err = s.close()
 			req.respChan <- req
@@ -152,19 +333,28 @@ func (s *MemoryStore) serve() {
 /* Below are the real work functions, should never be called externally. */
 func (s *MemoryStore) close() error {
 	close(s.commitQueue)
+	close(s.casQueue)
 	close(s.deleteQueue)
 	close(s.gcQueue)
 	close(s.getQueue)
+	close(s.touchQueue)
+	close(s.listQueue)
+	close(s.countQueue)
+	close(s.userQueue)
+	close(s.lifetimeQueue)
+	close(s.idleQueue)
 	close(s.closeChan)
 
 	s.store = nil
+	s.users = nil
 
 	return nil
 }
 
 func (s *MemoryStore) gc() error {
-	for k := range s.store {
-		if time.Since(s.store[k].lastUsed) > s.maxAge {
+	for k, stored := range s.store {
+		if s.expired(stored) {
+			s.unindex(stored)
 			delete(s.store, k)
 		}
 	}
@@ -174,33 +364,134 @@ func (s *MemoryStore) gc() error {
 
 func (s *MemoryStore) get(sid string) (*Session, error) {
 	stored, ok := s.store[sid]
-	if !ok {
+	if !ok || s.expired(stored) {
 		return nil, ErrNotFound
 	}
 
 	var ses Session
 	ses.Values = copyValues(stored.values)
+	ses.created = stored.created
+	ses.lastUsed = stored.lastUsed
+	ses.version = stored.version
+	ses.userID = stored.userID
+	ses.lastIP = stored.lastIP
+	ses.userAgent = stored.ua
+	ses.binding = stored.binding
+	ses.flashes = stored.flashes
 
 	return &ses, nil
 }
 
-func (s *MemoryStore) commit(ses *Session) error {
+func (s *MemoryStore) commit(ses *Session) (uint64, error) {
+	old := s.store[ses.sid]
 	store := storedSession{
 		sid:      ses.sid,
+		created:  ses.created,
 		lastUsed: time.Now(),
+		version:  old.version + 1,
+		userID:   ses.userID,
+		lastIP:   ses.lastIP,
+		ua:       ses.userAgent,
+		binding:  ses.binding,
+		flashes:  ses.flashes,
 		values:   copyValues(ses.Values),
 	}
+	s.unindex(old)
 	s.store[ses.sid] = store
+	s.index(store)
+
+	return store.version, nil
+}
+
+func (s *MemoryStore) commitVersion(ses *Session, version uint64) (uint64, error) {
+	if s.store[ses.sid].version != version {
+		return 0, ErrConflict
+	}
+
+	return s.commit(ses)
+}
+
+func (s *MemoryStore) touch(ses *Session) error {
+	stored, ok := s.store[ses.sid]
+	if ok {
+		stored.lastUsed = time.Now()
+		s.store[ses.sid] = stored
+	}
 
 	return nil
 }
 
+func (s *MemoryStore) list() ([]string, error) {
+	var sids []string
+	for k, stored := range s.store {
+		if !s.expired(stored) {
+			sids = append(sids, k)
+		}
+	}
+
+	return sids, nil
+}
+
+func (s *MemoryStore) count() (int, error) {
+	count := 0
+	for _, stored := range s.store {
+		if !s.expired(stored) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
 func (s *MemoryStore) delete(ses *Session) error {
+	s.unindex(s.store[ses.sid])
 	delete(s.store, ses.sid)
 
 	return nil
 }
 
+func (s *MemoryStore) sessionsForUser(uid string) ([]string, error) {
+	var sids []string
+	for sid := range s.users[uid] {
+		if !s.expired(s.store[sid]) {
+			sids = append(sids, sid)
+		}
+	}
+
+	return sids, nil
+}
+
+func (s *MemoryStore) index(stored storedSession) {
+	if stored.userID == "" {
+		return
+	}
+	if s.users[stored.userID] == nil {
+		s.users[stored.userID] = make(map[string]bool)
+	}
+	s.users[stored.userID][stored.sid] = true
+}
+
+func (s *MemoryStore) unindex(stored storedSession) {
+	sids := s.users[stored.userID]
+	delete(sids, stored.sid)
+	if len(sids) == 0 {
+		delete(s.users, stored.userID)
+	}
+}
+
+func (s *MemoryStore) expired(stored storedSession) bool {
+	if time.Since(stored.lastUsed) > s.maxAge {
+		return true
+	}
+	if s.idleTimeout != 0 && time.Since(stored.lastUsed) > s.idleTimeout {
+		return true
+	}
+	if s.maxLifetime != 0 && time.Since(stored.created) > s.maxLifetime {
+		return true
+	}
+	return false
+}
+
 func copyValues(src map[string]string) map[string]string {
 	newMap := make(map[string]string, len(src))
 
@@ -1,7 +1,8 @@
 package session
 
 import (
-	"net/http"
+	"context"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -20,7 +21,28 @@ func Test_MemoryStore(t *testing.T) {
 	}
 
 	memTest := SessionTestServer{t, sm}
-	go http.ListenAndServe(listen, memTest)
+	srv := httptest.NewServer(memTest)
+	defer srv.Close()
 
-	sessionTest(t)
+	sessionTest(t, srv.URL)
+}
+
+func Test_MemoryStoreContext(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := store.GetContext(ctx, "abc"); err != context.Canceled {
+		t.Errorf("GetContext with a cancelled context returned %v", err)
+	}
+
+	// The store keeps serving after abandoned requests.
+	if _, err := store.GetContext(context.Background(), "abc"); err != ErrNotFound {
+		t.Errorf("GetContext returned %v expected ErrNotFound", err)
+	}
 }
@@ -0,0 +1,119 @@
+package session
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxClientInfo bounds the stored address and User-Agent, which clients
+// control.
+const maxClientInfo = 512
+
+/*
+Session metadata is kept by the storage alongside Values. It can't be changed
+directly, the client is recorded by Begin and the rest maintained by the
+storage.
+*/
+
+// Created returns when the session was started.
+func (s *Session) Created() time.Time {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.created
+}
+
+/*
+LastUsed returns when the storage last saw the session committed, before the
+current request. Zero for new sessions.
+*/
+func (s *Session) LastUsed() time.Time {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.lastUsed
+}
+
+// LastIP returns the address of the latest client to use the session, see
+// SessionManager.ClientIP.
+func (s *Session) LastIP() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.lastIP
+}
+
+// UserAgent returns the User-Agent of the latest client to use the session.
+func (s *Session) UserAgent() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.userAgent
+}
+
+/*
+Commits returns how many times the session has been committed with changes
+since it was created or last moved to a new id. Commits that only touch the
+session aren't counted by storages implementing Toucher.
+*/
+func (s *Session) Commits() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.version
+}
+
+/*
+Inspect returns the session stored under sid without taking its lock, for
+showing its metadata such as with SessionsForUser. The session is read only
+as with BeginReadOnly. Returns ErrNotFound for missing or expired sessions.
+*/
+func (sm *SessionManager) Inspect(sid string) (*Session, error) {
+	stored, err := sm.storage.Get(sid)
+	if err != nil {
+		return nil, err
+	}
+	if sm.expired(stored) {
+		return nil, ErrNotFound
+	}
+
+	stored.sid = sid
+	stored.sm = sm
+	stored.readOnly = true
+	return stored, nil
+}
+
+// clientIP returns the address of the client making req.
+func (sm *SessionManager) clientIP(req *http.Request) string {
+	if sm.ClientIP != nil {
+		return sm.ClientIP(req)
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// recordClient notes the request's client in the metadata, marking the
+// session changed if it differs from the stored one.
+func (s *Session) recordClient() {
+	ip := truncate(s.sm.clientIP(s.req))
+	ua := truncate(s.req.UserAgent())
+
+	if ip != s.lastIP || ua != s.userAgent {
+		s.lastIP = ip
+		s.userAgent = ua
+		s.metaChanged = true
+	}
+}
+
+func truncate(info string) string {
+	if len(info) > maxClientInfo {
+		info = strings.ToValidUTF8(info[:maxClientInfo], "")
+	}
+	return info
+}
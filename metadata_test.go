@@ -0,0 +1,106 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_Metadata(t *testing.T) {
+	mem, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	metadataTest(t, mem)
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "meta.db"), 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatalf("bolt error: %s", err)
+	}
+	bs, err := NewBoltStore(db, 60*time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %s", err)
+	}
+	metadataTest(t, bs)
+}
+
+func metadataTest(t *testing.T, store SessionStorage) {
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	begin := func(sid string, addr string, ua string) *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("User-Agent", ua)
+		if sid != "" {
+			r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+		}
+		ses, err := sm.Begin(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Begin failed: %s", err)
+		}
+		return ses
+	}
+
+	inspect := func(sid string, ip string, ua string, commits uint64) {
+		t.Helper()
+		ses, err := sm.Inspect(sid)
+		if err != nil {
+			t.Fatalf("Inspect failed: %s", err)
+		}
+		if ses.LastIP() != ip || ses.UserAgent() != ua || ses.Commits() != commits {
+			t.Errorf("metadata %s '%s' %d, expected %s '%s' %d", ses.LastIP(), ses.UserAgent(), ses.Commits(), ip, ua, commits)
+		}
+		if ses.Created().IsZero() || time.Since(ses.LastUsed()) > time.Minute {
+			t.Errorf("times not kept, created %s last used %s", ses.Created(), ses.LastUsed())
+		}
+	}
+
+	ses := begin("", "192.0.2.1:1234", "browser/1")
+	created := ses.Created()
+	if !ses.LastUsed().IsZero() {
+		t.Errorf("new session already used")
+	}
+	ses.Commit()
+	sid := ses.sid
+	inspect(sid, "192.0.2.1", "browser/1", 1)
+
+	// An unchanged session from the same client is only touched.
+	ses = begin(sid, "192.0.2.1:5678", "browser/1")
+	if ses.LastUsed().IsZero() || !ses.Created().Equal(created) {
+		t.Errorf("metadata not loaded with the session")
+	}
+	ses.Commit()
+	inspect(sid, "192.0.2.1", "browser/1", 1)
+
+	// A new client is recorded even without changes.
+	ses = begin(sid, "[2001:db8::1]:1234", strings.Repeat("x", 1000))
+	ses.Commit()
+	inspect(sid, "2001:db8::1", strings.Repeat("x", maxClientInfo), 2)
+
+	// Behind a proxy.
+	sm.ClientIP = func(req *http.Request) string {
+		return req.Header.Get("X-Real-IP")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Real-IP", "198.51.100.7")
+	r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+	ses, err = sm.Begin(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	ses.Commit()
+	inspect(sid, "198.51.100.7", "", 3)
+
+	if _, err := sm.Inspect("missing"); err != ErrNotFound {
+		t.Errorf("Inspect of a missing session returned %v", err)
+	}
+}
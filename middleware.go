@@ -0,0 +1,144 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type contextKey int
+
+const sessionContextKey contextKey = 0
+
+/*
+Middleware wraps next so that every request has a session begun before next is
+called and committed after it returns. The session is available to next
+through FromContext.
+
+If next panics the session is not committed, but its lock is still released so
+later requests using the same session aren't blocked. If Begin fails next is
+not called: ErrLockTimeout is answered with a 503, requests whose context ended
+while waiting are left unanswered as the client is gone, and other failures
+are logged to ErrorLog and answered with a 500. Commit failures are logged to
+ErrorLog.
+
+With a RequestStorage the session is instead committed as soon as next starts
+writing its response, changing it after that point returns ErrCommitted.
+*/
+func (sm *SessionManager) Middleware(next http.Handler) http.Handler {
+	return sm.middleware(next, sm.Begin)
+}
+
+/*
+ReadOnlyMiddleware is Middleware for handlers that only read the session,
+using BeginReadOnly in place of Begin.
+*/
+func (sm *SessionManager) ReadOnlyMiddleware(next http.Handler) http.Handler {
+	return sm.middleware(next, sm.BeginReadOnly)
+}
+
+func (sm *SessionManager) middleware(next http.Handler, begin func(http.ResponseWriter, *http.Request) (*Session, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Commit or release exactly once.
+		var ses *Session
+		var once sync.Once
+		commit := func() {
+			once.Do(func() {
+				// next may have committed already, which is fine.
+				err := ses.Commit()
+				if err != nil && err != ErrCommitted {
+					sm.logf("session: failed to commit session: %s", err)
+				}
+			})
+		}
+
+		// The session gets the wrapped writer, so the storage can tell if the
+		// response was written before it.
+		out := w
+		if _, ok := sm.storage.(RequestStorage); ok {
+			out = &commitWriter{ResponseWriter: w, commit: commit}
+		}
+
+		ses, err := begin(out, req)
+		switch {
+		case err == nil:
+		case req.Context().Err() != nil:
+			return
+		case err == ErrLockTimeout:
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		default:
+			sm.logf("session: failed to begin session: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		finished := false
+		defer func() {
+			if !finished {
+				once.Do(ses.release)
+			}
+		}()
+
+		next.ServeHTTP(out, req.WithContext(NewContext(req.Context(), ses)))
+		finished = true
+
+		commit()
+	})
+}
+
+// commitWriter commits the session before the response headers are sent.
+type commitWriter struct {
+	http.ResponseWriter
+	commit func()
+
+	// written is set once the headers have been sent.
+	written bool
+}
+
+func (cw *commitWriter) WriteHeader(code int) {
+	cw.commit()
+	cw.written = true
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *commitWriter) Write(b []byte) (int, error) {
+	cw.commit()
+	cw.written = true
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *commitWriter) Flush() {
+	cw.commit()
+	cw.written = true
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// responseWritten reports whether w is known to have sent its headers.
+func responseWritten(w http.ResponseWriter) bool {
+	cw, ok := w.(*commitWriter)
+	return ok && cw.written
+}
+
+// Unwrap allows http.ResponseController to reach the original writer.
+func (cw *commitWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+/*
+NewContext returns a copy of ctx carrying ses. Middleware does this for you.
+*/
+func NewContext(ctx context.Context, ses *Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey, ses)
+}
+
+/*
+FromContext returns the session stored in ctx by Middleware, or nil if there
+is none.
+*/
+func FromContext(ctx context.Context) *Session {
+	ses, _ := ctx.Value(sessionContextKey).(*Session)
+	return ses
+}
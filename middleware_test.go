@@ -0,0 +1,113 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_Middleware(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	h := sm.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ses := FromContext(req.Context())
+		if ses == nil {
+			t.Errorf("no session in request context")
+			return
+		}
+
+		if req.FormValue("panic") != "" {
+			panic("handler failure")
+		}
+		if v := req.FormValue("put"); v != "" {
+			ses.Set("value", v)
+		}
+		fmt.Fprint(w, ses.Get("value"))
+	}))
+
+	// First request sets a value and gets a cookie.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?put=stored", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatalf("no session cookie set")
+	}
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.AddCookie(cookies[0])
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// The value was committed without the handler calling Commit.
+	if body := serve("/").Body.String(); body != "stored" {
+		t.Errorf("got '%s' expected 'stored'", body)
+	}
+
+	// A panicking handler must not leave the session locked.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic to propagate")
+			}
+		}()
+		serve("/?panic=true")
+	}()
+
+	done := make(chan string)
+	go func() {
+		done <- serve("/").Body.String()
+	}()
+
+	select {
+	case body := <-done:
+		if body != "stored" {
+			t.Errorf("got '%s' after panic expected 'stored'", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("session still locked after handler panic")
+	}
+
+	// Waiting for a busy session is not a server error.
+	var logged bytes.Buffer
+	sm.ErrorLog = log.New(&logged, "", 0)
+	sm.SetLockTimeout(50 * time.Millisecond)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	held, err := sm.Begin(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	if code := serve("/").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("lock timeout answered with %d, expected 503", code)
+	}
+
+	sm.SetLockTimeout(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.AddCookie(cookies[0])
+	h.ServeHTTP(rec, r)
+	if rec.Code == http.StatusInternalServerError || logged.Len() != 0 {
+		t.Errorf("canceled request answered with %d and logged '%s'", rec.Code, logged.String())
+	}
+	held.Commit()
+}
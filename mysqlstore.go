@@ -1,10 +1,17 @@
 package session
 
 import (
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 /*
@@ -16,11 +23,44 @@ type MySQLStore struct {
 	commitSessionStmt *sql.Stmt
 	gcSessionStmt     *sql.Stmt
 	delSessionStmt    *sql.Stmt
+	touchSessionStmt  *sql.Stmt
+	listSessionStmt   *sql.Stmt
+	countSessionStmt  *sql.Stmt
+	insertSessionStmt *sql.Stmt
+	casSessionStmt    *sql.Stmt
+	userSessionStmt   *sql.Stmt
+
+	maxAge      time.Duration
+	maxLifetime time.Duration
+	idleTimeout time.Duration
+	sync.RWMutex
+
+	tablename string
+	locksLock sync.Mutex
+	locks     map[string]*sql.Conn
 }
 
+// lockRetryInterval is how many seconds a single GET_LOCK waits before ctx is
+// checked again.
+const lockRetryInterval = 1
+
 /*
 NewMySQLStore creates a MySQLStore SessionStorage using the given database and
 tablename. The table will be created if it does not exist.
+
+Tables created by earlier versions need the newer columns added:
+
+	ALTER TABLE sessions ADD `ctime` bigint NOT NULL DEFAULT 0 AFTER `sid`;
+	UPDATE sessions SET ctime = unix_timestamp(atime) WHERE ctime = 0;
+	ALTER TABLE sessions ADD `version` bigint unsigned NOT NULL DEFAULT 0 AFTER `atime`;
+	ALTER TABLE sessions MODIFY `sid` varchar(128) NOT NULL;
+	ALTER TABLE sessions ADD `uid` varchar(255) NOT NULL DEFAULT '' AFTER `sid`, ADD KEY `uid` (`uid`);
+	ALTER TABLE sessions ADD `ip` varchar(512) NOT NULL DEFAULT '' AFTER `version`, ADD `ua` varchar(512) NOT NULL DEFAULT '' AFTER `ip`;
+	ALTER TABLE sessions ADD `binding` varchar(255) NOT NULL DEFAULT '' AFTER `ua`;
+	ALTER TABLE sessions ADD `flashes` text NOT NULL AFTER `binding`;
+
+Without the UPDATE existing sessions have no creation time and are exempt from
+SetMaxLifetime until they expire through disuse.
 */
 func NewMySQLStore(db *sql.DB, tablename string, maxAge time.Duration) (*MySQLStore, error) {
 	var s MySQLStore
@@ -30,34 +70,73 @@ func NewMySQLStore(db *sql.DB, tablename string, maxAge time.Duration) (*MySQLSt
 	}
 
 	s.db = db
+	s.tablename = tablename
+	s.maxAge = maxAge
+	s.locks = make(map[string]*sql.Conn)
 
 	_, err := db.Query(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (", tablename) +
-		" `sid` char(40) NOT NULL," +
+		" `sid` varchar(128) NOT NULL," +
+		" `uid` varchar(255) NOT NULL DEFAULT ''," +
+		" `ctime` bigint NOT NULL DEFAULT 0," +
 		" `atime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP," +
+		" `version` bigint unsigned NOT NULL DEFAULT 0," +
+		" `ip` varchar(512) NOT NULL DEFAULT ''," +
+		" `ua` varchar(512) NOT NULL DEFAULT ''," +
+		" `binding` varchar(255) NOT NULL DEFAULT ''," +
+		" `flashes` text NOT NULL," +
 		" `data` text NOT NULL," +
 		" PRIMARY KEY (`sid`)," +
-		" KEY `atime` (`atime`)" +
+		" KEY `atime` (`atime`)," +
+		" KEY `uid` (`uid`)" +
 		" ) ENGINE=MyISAM DEFAULT CHARSET=utf8")
 	if err != nil {
 		return nil, fmt.Errorf("failed attempting to create table: %s", err)
 	}
 
-	s.startSessionStmt, err = db.Prepare(fmt.Sprintf("select data from sessions where sid = ? and subdate(now(), interval %d second) < atime", int(maxAge.Seconds())))
+	// Creation times are unix seconds supplied by us, compared against a
+	// cutoff we compute, so they are unaffected by the server's time zone. A
+	// ctime of 0 is an unknown creation time and never outlives the lifetime.
+	s.startSessionStmt, err = db.Prepare(fmt.Sprintf("select data, ctime, unix_timestamp(atime), version, uid, ip, ua, binding, flashes from `%s` where sid = ? and subdate(now(), interval ? second) < atime and (ctime = 0 or ctime >= ?)", tablename))
 	if err != nil {
 		return nil, fmt.Errorf("failed preparing startSessionStmt: %s", err)
 	}
-	s.commitSessionStmt, err = db.Prepare("replace into sessions (sid, data) VALUES (?, ?)")
+	s.commitSessionStmt, err = db.Prepare(fmt.Sprintf("insert into `%s` (sid, uid, ctime, version, ip, ua, binding, flashes, data) VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?)"+
+		" on duplicate key update uid = values(uid), ctime = values(ctime), ip = values(ip), ua = values(ua), binding = values(binding), flashes = values(flashes), data = values(data), version = version + 1, atime = now()", tablename))
 	if err != nil {
 		return nil, fmt.Errorf("failed preparing commitSessionStmt: %s", err)
 	}
-	s.gcSessionStmt, err = db.Prepare(fmt.Sprintf("delete from sessions where subdate(now(), interval %d second) > atime", int(maxAge.Seconds())))
+	s.gcSessionStmt, err = db.Prepare(fmt.Sprintf("delete from `%s` where subdate(now(), interval ? second) > atime or (ctime <> 0 and ctime < ?)", tablename))
 	if err != nil {
 		return nil, fmt.Errorf("failed preparing gcSessionStmt: %s", err)
 	}
-	s.delSessionStmt, err = db.Prepare("delete from sessions where sid = ?")
+	s.delSessionStmt, err = db.Prepare(fmt.Sprintf("delete from `%s` where sid = ?", tablename))
 	if err != nil {
 		return nil, fmt.Errorf("failed preparing delSessionStmt: %s", err)
 	}
+	s.touchSessionStmt, err = db.Prepare(fmt.Sprintf("update `%s` set atime = now() where sid = ?", tablename))
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing touchSessionStmt: %s", err)
+	}
+	s.listSessionStmt, err = db.Prepare(fmt.Sprintf("select sid from `%s` where subdate(now(), interval ? second) < atime and (ctime = 0 or ctime >= ?)", tablename))
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing listSessionStmt: %s", err)
+	}
+	s.countSessionStmt, err = db.Prepare(fmt.Sprintf("select count(*) from `%s` where subdate(now(), interval ? second) < atime and (ctime = 0 or ctime >= ?)", tablename))
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing countSessionStmt: %s", err)
+	}
+	s.insertSessionStmt, err = db.Prepare(fmt.Sprintf("insert into `%s` (sid, uid, ctime, version, ip, ua, binding, flashes, data) VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?)", tablename))
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing insertSessionStmt: %s", err)
+	}
+	s.casSessionStmt, err = db.Prepare(fmt.Sprintf("update `%s` set uid = ?, ip = ?, ua = ?, binding = ?, flashes = ?, data = ?, version = version + 1, atime = now() where sid = ? and version = ?", tablename))
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing casSessionStmt: %s", err)
+	}
+	s.userSessionStmt, err = db.Prepare(fmt.Sprintf("select sid from `%s` where uid = ? and subdate(now(), interval ? second) < atime and (ctime = 0 or ctime >= ?)", tablename))
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing userSessionStmt: %s", err)
+	}
 
 	return &s, nil
 }
@@ -68,6 +147,12 @@ func (s *MySQLStore) Close() error {
 	err2 := s.commitSessionStmt.Close()
 	err3 := s.gcSessionStmt.Close()
 	err4 := s.delSessionStmt.Close()
+	err5 := s.touchSessionStmt.Close()
+	err6 := s.listSessionStmt.Close()
+	err7 := s.countSessionStmt.Close()
+	err8 := s.insertSessionStmt.Close()
+	err9 := s.casSessionStmt.Close()
+	err10 := s.userSessionStmt.Close()
 
 	if err1 != nil {
 		return fmt.Errorf("error closing startSessionStmt: %s", err1)
@@ -81,23 +166,100 @@ func (s *MySQLStore) Close() error {
 	if err4 != nil {
 		return fmt.Errorf("error closing delSessionStmt: %s", err4)
 	}
+	if err5 != nil {
+		return fmt.Errorf("error closing touchSessionStmt: %s", err5)
+	}
+	if err6 != nil {
+		return fmt.Errorf("error closing listSessionStmt: %s", err6)
+	}
+	if err7 != nil {
+		return fmt.Errorf("error closing countSessionStmt: %s", err7)
+	}
+	if err8 != nil {
+		return fmt.Errorf("error closing insertSessionStmt: %s", err8)
+	}
+	if err9 != nil {
+		return fmt.Errorf("error closing casSessionStmt: %s", err9)
+	}
+	if err10 != nil {
+		return fmt.Errorf("error closing userSessionStmt: %s", err10)
+	}
+	return nil
+}
+
+/*
+SetMaxLifetime sets the absolute lifetime of sessions measured from their
+creation. Zero disables the limit. Normally set through
+SessionManager.SetMaxLifetime.
+*/
+func (s *MySQLStore) SetMaxLifetime(lifetime time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maxLifetime = lifetime
 	return nil
 }
 
+/*
+SetIdleTimeout expires sessions unused for timeout, when shorter than maxAge.
+Zero leaves expiry to maxAge. Normally set through
+SessionManager.SetIdleTimeout.
+*/
+func (s *MySQLStore) SetIdleTimeout(timeout time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.idleTimeout = timeout
+	return nil
+}
+
+// idleSeconds returns how long sessions may go unused, in seconds.
+func (s *MySQLStore) idleSeconds() int64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.idleTimeout != 0 && s.idleTimeout < s.maxAge {
+		return int64(s.idleTimeout.Seconds())
+	}
+	return int64(s.maxAge.Seconds())
+}
+
+// createdCutoff returns the oldest creation time still within the lifetime.
+func (s *MySQLStore) createdCutoff() int64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.maxLifetime == 0 {
+		return 0
+	}
+	return time.Now().Add(-s.maxLifetime).Unix()
+}
+
 // GC one pass over the MySQLStore
 func (s *MySQLStore) GC() error {
-	_, err := s.gcSessionStmt.Exec()
+	_, err := s.gcSessionStmt.Exec(s.idleSeconds(), s.createdCutoff())
 	return err
 }
 
 // Get session associated with sid.
 func (s *MySQLStore) Get(sid string) (*Session, error) {
+	return s.GetContext(context.Background(), sid)
+}
+
+// GetContext gets the session associated with sid, abandoning the query when
+// ctx is done.
+func (s *MySQLStore) GetContext(ctx context.Context, sid string) (*Session, error) {
 	var ses Session
 
 	var sessionJSON []byte
-	err := s.startSessionStmt.QueryRow(sid).Scan(&sessionJSON)
+	var ctime, atime int64
+	err := s.startSessionStmt.QueryRowContext(ctx, sid, s.idleSeconds(), s.createdCutoff()).Scan(&sessionJSON, &ctime, &atime, &ses.version, &ses.userID, &ses.lastIP, &ses.userAgent, &ses.binding, &ses.flashes)
 	if err == nil {
 		ses.sid = sid
+		if ctime != 0 {
+			ses.created = time.Unix(ctime, 0)
+		}
+		ses.lastUsed = time.Unix(atime, 0)
 		json.Unmarshal(sessionJSON, &ses.Values)
 		return &ses, nil
 	}
@@ -109,22 +271,210 @@ func (s *MySQLStore) Get(sid string) (*Session, error) {
 
 // Commit session back to storage.
 func (s *MySQLStore) Commit(ses *Session) error {
+	return s.CommitContext(context.Background(), ses)
+}
+
+// CommitContext commits the session, abandoning the query when ctx is done.
+func (s *MySQLStore) CommitContext(ctx context.Context, ses *Session) error {
 	if ses.sid != "" {
 		sessionJSON, err := json.Marshal(ses.Values)
 		if err != nil {
 			return err
 		}
-		_, err = s.commitSessionStmt.Exec(ses.sid, sessionJSON)
+		_, err = s.commitSessionStmt.ExecContext(ctx, ses.sid, ses.userID, createdUnix(ses), ses.lastIP, ses.userAgent, ses.binding, ses.flashes, sessionJSON)
 		if err != nil {
 			return err
 		}
+		ses.version++
+	}
+
+	return nil
+}
+
+/*
+CommitVersion commits the session only if its version matches the stored row,
+otherwise returns ErrConflict. The check is part of the insert or update
+itself so it holds across servers sharing the table.
+*/
+func (s *MySQLStore) CommitVersion(ctx context.Context, ses *Session) error {
+	sessionJSON, err := json.Marshal(ses.Values)
+	if err != nil {
+		return err
+	}
+
+	var res sql.Result
+	if ses.version == 0 {
+		res, err = s.insertSessionStmt.ExecContext(ctx, ses.sid, ses.userID, createdUnix(ses), ses.lastIP, ses.userAgent, ses.binding, ses.flashes, sessionJSON)
+	} else {
+		res, err = s.casSessionStmt.ExecContext(ctx, ses.userID, ses.lastIP, ses.userAgent, ses.binding, ses.flashes, sessionJSON, ses.sid, ses.version)
+	}
+	if isDuplicateKey(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
 	}
 
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrConflict
+	}
+
+	ses.version++
 	return nil
 }
 
+// createdUnix returns the session's ctime column value.
+func createdUnix(ses *Session) int64 {
+	if ses.created.IsZero() {
+		return 0
+	}
+	return ses.created.Unix()
+}
+
+// Touch updates the session's last used time without rewriting its data.
+func (s *MySQLStore) Touch(ses *Session) error {
+	return s.TouchContext(context.Background(), ses)
+}
+
+// TouchContext touches the session, abandoning the query when ctx is done.
+func (s *MySQLStore) TouchContext(ctx context.Context, ses *Session) error {
+	_, err := s.touchSessionStmt.ExecContext(ctx, ses.sid)
+	return err
+}
+
+// List the ids of all unexpired sessions.
+func (s *MySQLStore) List() ([]string, error) {
+	rows, err := s.listSessionStmt.Query(s.idleSeconds(), s.createdCutoff())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sids []string
+	for rows.Next() {
+		var sid string
+		err = rows.Scan(&sid)
+		if err != nil {
+			return nil, err
+		}
+		sids = append(sids, sid)
+	}
+
+	return sids, rows.Err()
+}
+
+// SessionsForUser returns the ids of the unexpired sessions of uid.
+func (s *MySQLStore) SessionsForUser(uid string) ([]string, error) {
+	rows, err := s.userSessionStmt.Query(uid, s.idleSeconds(), s.createdCutoff())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sids []string
+	for rows.Next() {
+		var sid string
+		err = rows.Scan(&sid)
+		if err != nil {
+			return nil, err
+		}
+		sids = append(sids, sid)
+	}
+
+	return sids, rows.Err()
+}
+
+// Count the unexpired sessions.
+func (s *MySQLStore) Count() (int, error) {
+	var count int
+	err := s.countSessionStmt.QueryRow(s.idleSeconds(), s.createdCutoff()).Scan(&count)
+	return count, err
+}
+
 // Delete session from storage.
 func (s *MySQLStore) Delete(ses *Session) error {
-	_, err := s.delSessionStmt.Exec(ses.sid)
+	return s.DeleteContext(context.Background(), ses)
+}
+
+// DeleteContext deletes the session, abandoning the query when ctx is done.
+func (s *MySQLStore) DeleteContext(ctx context.Context, ses *Session) error {
+	_, err := s.delSessionStmt.ExecContext(ctx, ses.sid)
 	return err
 }
+
+/*
+LockSession takes a MySQL named lock on sid, shared by every server using the
+same database and table. Named locks belong to a connection, so one is held
+out of the pool until UnlockSession. They are released by the server if the
+connection is lost.
+*/
+func (s *MySQLStore) LockSession(ctx context.Context, sid string) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := s.lockName(sid)
+	for {
+		var got sql.NullInt64
+		err = conn.QueryRowContext(ctx, "select get_lock(?, ?)", name, lockRetryInterval).Scan(&got)
+		if err == nil && got.Valid && got.Int64 == 1 {
+			break
+		}
+		if err == nil && !got.Valid {
+			// NULL means an error in get_lock, such as running out of memory
+			// or the thread being killed, retrying won't help.
+			err = fmt.Errorf("get_lock failed on session %s", sid)
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	s.locksLock.Lock()
+	s.locks[sid] = conn
+	s.locksLock.Unlock()
+	return nil
+}
+
+// UnlockSession releases the named lock on sid and returns its connection to
+// the pool.
+func (s *MySQLStore) UnlockSession(sid string) error {
+	s.locksLock.Lock()
+	conn, ok := s.locks[sid]
+	delete(s.locks, sid)
+	s.locksLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	_, err := conn.ExecContext(context.Background(), "do release_lock(?)", s.lockName(sid))
+	cerr := conn.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// isDuplicateKey reports whether err is MySQL's duplicate key error, meaning
+// another server inserted the session first.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// lockName returns the named lock for sid, hashed to fit MySQL's 64 character
+// limit on lock names.
+func (s *MySQLStore) lockName(sid string) string {
+	h := sha1.Sum([]byte(s.tablename + ":" + sid))
+	return "session:" + hex.EncodeToString(h[:])
+}
@@ -1,10 +1,11 @@
 package session
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	_ "github.com/go-sql-driver/mysql"
-	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -23,6 +24,13 @@ func Test_MySQLStore(t *testing.T) {
 		return
 	}
 
+	// Start from an empty table, sessions left by earlier runs would show up
+	// in the user index.
+	if _, err := db.Exec("DROP TABLE IF EXISTS session_test"); err != nil {
+		t.Errorf("Error dropping test table: %s", err)
+		return
+	}
+
 	store, err := NewMySQLStore(db, "session_test", 60*time.Minute)
 	if err != nil {
 		t.Errorf("failed to create memory store: %s", err)
@@ -36,7 +44,101 @@ func Test_MySQLStore(t *testing.T) {
 	}
 
 	memTest := SessionTestServer{t, sm}
-	go http.ListenAndServe(listen, memTest)
+	srv := httptest.NewServer(memTest)
+	defer srv.Close()
+
+	sessionTest(t, srv.URL)
+	typedValuesTest(t, sm)
+	userIndexTest(t, newMySQLTestStore(t, db))
+	metadataTest(t, newMySQLTestStore(t, db))
+}
+
+func Test_MySQLStoreCommitVersion(t *testing.T) {
+	if *DSN == "" {
+		t.Log("SQL versioned commits untested. Please re-run with -dsn=\"go-mysql-driver dsn\"")
+		return
+	}
 
-	sessionTest(t)
+	db, err := sql.Open("mysql", *DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %s", err)
+	}
+	store := newMySQLTestStore(t, db)
+	defer store.Close()
+
+	ctx := context.Background()
+	store.Delete(&Session{sid: "abc"})
+
+	a := &Session{sid: "abc", sessionMeta: sessionMeta{created: time.Now()}, Values: map[string]string{"v": "a"}}
+	if err := store.CommitVersion(ctx, a); err != nil || a.version != 1 {
+		t.Fatalf("first commit returned %v, version %d", err, a.version)
+	}
+
+	// A second new session for the same id hits the primary key.
+	b := &Session{sid: "abc", sessionMeta: sessionMeta{created: time.Now()}, Values: map[string]string{"v": "b"}}
+	if err := store.CommitVersion(ctx, b); err != ErrConflict {
+		t.Errorf("commit of stale version returned %v, expected ErrConflict", err)
+	}
+
+	stored, err := store.Get("abc")
+	if err != nil || stored.version != 1 || stored.Values["v"] != "a" {
+		t.Fatalf("stored session wrong after conflict: %v", err)
+	}
+
+	stored.Values["v"] = "c"
+	if err := store.CommitVersion(ctx, stored); err != nil || stored.version != 2 {
+		t.Errorf("commit of current version returned %v, version %d", err, stored.version)
+	}
+
+	// The compare and swap fails for the version it just replaced.
+	a.Values["v"] = "d"
+	if err := store.CommitVersion(ctx, a); err != ErrConflict {
+		t.Errorf("commit of replaced version returned %v, expected ErrConflict", err)
+	}
+}
+
+func Test_MySQLStoreUnknownCreation(t *testing.T) {
+	if *DSN == "" {
+		t.Log("SQL session lifetime untested. Please re-run with -dsn=\"go-mysql-driver dsn\"")
+		return
+	}
+
+	db, err := sql.Open("mysql", *DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %s", err)
+	}
+	store := newMySQLTestStore(t, db)
+	defer store.Close()
+
+	// Rows from before the ctime column have a ctime of 0.
+	store.Delete(&Session{sid: "legacy"})
+	_, err = db.Exec("insert into session_test (sid, flashes, data) values ('legacy', '', '{\"user\":\"bob\"}')")
+	if err != nil {
+		t.Fatalf("failed to insert legacy session: %s", err)
+	}
+
+	store.SetMaxLifetime(time.Hour)
+	ses, err := store.Get("legacy")
+	if err != nil || ses.Values["user"] != "bob" {
+		t.Fatalf("legacy session expired by the lifetime: %v", err)
+	}
+	if !ses.created.IsZero() {
+		t.Errorf("unknown creation time read as %s", ses.created)
+	}
+	if err := store.GC(); err != nil {
+		t.Fatalf("GC failed: %s", err)
+	}
+	if _, err := store.Get("legacy"); err != nil {
+		t.Errorf("legacy session removed by GC: %v", err)
+	}
+}
+
+// newMySQLTestStore returns another store on the test table, for tests that
+// close the store they are given.
+func newMySQLTestStore(t *testing.T, db *sql.DB) *MySQLStore {
+	store, err := NewMySQLStore(db, "session_test", 60*time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create mysql store: %s", err)
+	}
+	return store
 }
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+VersionedStorage is an optional interface for SessionStorage, required for
+optimistic concurrency. Storages keep a version for each session, increased on
+every Commit and returned by Get.
+
+CommitVersion commits the session only if the stored version still matches the
+session's, a session with version zero must not be stored yet. Otherwise it
+returns ErrConflict. On success the session's version is updated.
+*/
+type VersionedStorage interface {
+	CommitVersion(ctx context.Context, session *Session) error
+}
+
+/*
+ErrConflict is returned by Commit in optimistic mode when another request
+committed the session first and no MergeFunc resolved it.
+*/
+var ErrConflict = errors.New("session was changed by another request")
+
+/*
+MergeFunc resolves a conflicting commit in optimistic mode. It receives the
+values as they were when the session was begun, as they are now in storage
+and as this request left them, and returns the values to commit.
+*/
+type MergeFunc func(original, current, mine map[string]string) map[string]string
+
+// mergeAttempts bounds how often a commit is merged and retried.
+const mergeAttempts = 3
+
+/*
+SetOptimistic switches between the default pessimistic locking, where Begin
+waits for other requests using the session, and optimistic concurrency, where
+requests proceed in parallel and Commit detects if another request committed
+first. Conflicts are passed to merge if given, or reported as ErrConflict.
+
+Optimistic mode requires the storage to implement VersionedStorage.
+*/
+func (sm *SessionManager) SetOptimistic(optimistic bool, merge MergeFunc) error {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if _, ok := sm.storage.(VersionedStorage); optimistic && !ok {
+		return ErrNotSupported
+	}
+
+	sm.optimistic = optimistic
+	sm.merge = merge
+	return nil
+}
+
+// commitVersioned commits a changed session in optimistic mode, the session
+// must be locked.
+func (s *Session) commitVersioned() error {
+	vs := s.sm.storage.(VersionedStorage)
+	ctx := s.writeContext()
+
+	s.sm.RLock()
+	merge := s.sm.merge
+	s.sm.RUnlock()
+
+	for attempt := 0; ; attempt++ {
+		err := vs.CommitVersion(ctx, s)
+		if err != ErrConflict || merge == nil || attempt == mergeAttempts {
+			return err
+		}
+
+		current, err := s.sm.get(s.req, s.sid)
+		if err == ErrNotFound {
+			// Removed by the other request, nothing to merge with.
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+
+		s.Values = merge(s.loaded, current.Values, s.Values)
+		s.loaded = copyValues(current.Values)
+		s.version = current.version
+	}
+}
@@ -0,0 +1,125 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_Optimistic(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+	ses.Commit()
+	sid := ses.sid
+
+	err := sm.SetOptimistic(true, nil)
+	if err != nil {
+		t.Fatalf("SetOptimistic failed: %s", err)
+	}
+
+	resume := func() *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+		ses, err := sm.Begin(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Begin failed: %s", err)
+		}
+		return ses
+	}
+
+	// Both begin without waiting on each other, the second commit loses.
+	a, b := resume(), resume()
+	a.Set("a", "1")
+	b.Set("b", "2")
+	if err := a.Commit(); err != nil {
+		t.Fatalf("first commit failed: %s", err)
+	}
+	if err := b.Commit(); err != ErrConflict {
+		t.Errorf("second commit returned %v, expected ErrConflict", err)
+	}
+
+	// Unchanged sessions never conflict.
+	a, b = resume(), resume()
+	a.Set("a", "3")
+	a.Commit()
+	if err := b.Commit(); err != nil {
+		t.Errorf("read only commit returned %s", err)
+	}
+
+	// A merge function resolves conflicts.
+	sm.SetOptimistic(true, func(original, current, mine map[string]string) map[string]string {
+		merged := copyValues(current)
+		for k, v := range mine {
+			if original[k] != v {
+				merged[k] = v
+			}
+		}
+		return merged
+	})
+
+	a, b = resume(), resume()
+	a.Set("a", "4")
+	b.Set("b", "5")
+	a.Commit()
+	if err := b.Commit(); err != nil {
+		t.Fatalf("merged commit failed: %s", err)
+	}
+
+	ses = resume()
+	if ses.Get("a") != "4" || ses.Get("b") != "5" {
+		t.Errorf("merge lost a change, got a=%s b=%s", ses.Get("a"), ses.Get("b"))
+	}
+	ses.Commit()
+
+	// Storages without versions can't be used optimistically.
+	cookies, _ := NewCookieStore(CookieConfig{Name: "test_data"}, time.Hour, make([]byte, 32))
+	csm, err := NewSessionManager(cookies, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer csm.Close()
+	if err := csm.SetOptimistic(true, nil); err != ErrNotSupported {
+		t.Errorf("SetOptimistic on CookieStore returned %v", err)
+	}
+}
+
+func Test_BoltStoreCommitVersion(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "version.db"), 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatalf("bolt error: %s", err)
+	}
+
+	store, err := NewBoltStore(db, 60*time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %s", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	a := &Session{sid: "abc", sessionMeta: sessionMeta{created: time.Now()}, Values: map[string]string{"v": "a"}}
+	if err := store.CommitVersion(ctx, a); err != nil || a.version != 1 {
+		t.Fatalf("first commit returned %v, version %d", err, a.version)
+	}
+
+	// A second new session for the same id conflicts.
+	b := &Session{sid: "abc", sessionMeta: sessionMeta{created: time.Now()}, Values: map[string]string{"v": "b"}}
+	if err := store.CommitVersion(ctx, b); err != ErrConflict {
+		t.Errorf("commit of stale version returned %v, expected ErrConflict", err)
+	}
+
+	stored, err := store.Get("abc")
+	if err != nil || stored.version != 1 || stored.Values["v"] != "a" {
+		t.Fatalf("stored session wrong after conflict: %v", err)
+	}
+
+	stored.sid = "abc"
+	stored.Values["v"] = "c"
+	if err := store.CommitVersion(ctx, stored); err != nil || stored.version != 2 {
+		t.Errorf("commit of current version returned %v, version %d", err, stored.version)
+	}
+}
@@ -0,0 +1,131 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+CSRFMode selects how CanAct, and so CSRFMiddleware, decides a request is
+genuine, see SetTrustedOrigins.
+*/
+type CSRFMode int
+
+const (
+	// CSRFToken requires a valid action token, the default.
+	CSRFToken CSRFMode = iota
+
+	// CSRFOrigin requires the request to come from a trusted origin, for
+	// fetch() based APIs that can't easily send a token.
+	CSRFOrigin
+
+	// CSRFOriginAndToken requires both.
+	CSRFOriginAndToken
+)
+
+/*
+SetTrustedOrigins sets the CSRF mode and the origins, such as
+"https://example.com", trusted to make state changing requests.
+
+A request's origin is taken from its Origin header, or failing that its
+Referer. Requests a browser marks as same-origin with Sec-Fetch-Site are
+trusted without consulting the list. Requests carrying none of these headers
+are rejected, browsers send them with every unsafe request so only other
+clients are affected.
+
+The origin modes need at least one origin.
+*/
+func (sm *SessionManager) SetTrustedOrigins(mode CSRFMode, origins ...string) error {
+	if mode < CSRFToken || mode > CSRFOriginAndToken {
+		return errors.New("invalid CSRFMode")
+	}
+	if mode != CSRFToken && len(origins) == 0 {
+		return errors.New("origin checks need trusted origins")
+	}
+
+	trusted := make(map[string]bool)
+	for _, o := range origins {
+		origin, err := parseOrigin(o)
+		if err != nil {
+			return fmt.Errorf("invalid trusted origin %q: %s", o, err)
+		}
+		trusted[origin] = true
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.csrfMode = mode
+	sm.trustedOrigins = trusted
+	return nil
+}
+
+// parseOrigin returns the normalised scheme://host[:port] of an origin or
+// referer URL.
+func parseOrigin(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("scheme must be http or https")
+	}
+	if u.Host == "" || u.User != nil {
+		return "", errors.New("missing host")
+	}
+
+	host := strings.ToLower(u.Host)
+	if u.Scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	} else {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	return u.Scheme + "://" + host, nil
+}
+
+// trustedOrigin reports whether req comes from a trusted origin.
+func (sm *SessionManager) trustedOrigin(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+
+	if req.Header.Get("Sec-Fetch-Site") == "same-origin" {
+		return true
+	}
+
+	raw := req.Header.Get("Origin")
+	if raw == "" {
+		raw = req.Header.Get("Referer")
+	}
+	if raw == "" || raw == "null" {
+		return false
+	}
+
+	origin, err := parseOrigin(raw)
+	if err != nil {
+		return false
+	}
+
+	sm.RLock()
+	defer sm.RUnlock()
+
+	return sm.trustedOrigins[origin]
+}
+
+// canAct applies the CSRF mode, tokenOK checks the request's token.
+func (s *Session) canAct(tokenOK func() bool) bool {
+	s.sm.RLock()
+	mode := s.sm.csrfMode
+	s.sm.RUnlock()
+
+	if mode != CSRFToken && !s.sm.trustedOrigin(s.req) {
+		return false
+	}
+	if mode == CSRFOrigin {
+		return true
+	}
+	return tokenOK()
+}
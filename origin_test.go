@@ -0,0 +1,56 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_TrustedOrigins(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+	defer ses.Commit()
+
+	if err := sm.SetTrustedOrigins(CSRFOrigin); err == nil {
+		t.Errorf("origin mode without origins accepted")
+	}
+	if err := sm.SetTrustedOrigins(CSRFOrigin, "example.com"); err == nil {
+		t.Errorf("origin without a scheme accepted")
+	}
+
+	token := ses.ActionToken()
+	tests := []struct {
+		mode    CSRFMode
+		headers map[string]string
+		ok      bool
+	}{
+		{CSRFOrigin, map[string]string{"Origin": "https://app.example.com"}, true},
+		{CSRFOrigin, map[string]string{"Origin": "https://APP.example.com:443"}, true},
+		{CSRFOrigin, map[string]string{"Referer": "https://app.example.com/page?q=1"}, true},
+		{CSRFOrigin, map[string]string{"Sec-Fetch-Site": "same-origin"}, true},
+		{CSRFOrigin, map[string]string{"Origin": "https://evil.example.com"}, false},
+		{CSRFOrigin, map[string]string{"Origin": "http://app.example.com"}, false},
+		{CSRFOrigin, map[string]string{"Origin": "null"}, false},
+		{CSRFOrigin, map[string]string{"Sec-Fetch-Site": "cross-site"}, false},
+		{CSRFOrigin, map[string]string{}, false},
+		{CSRFOriginAndToken, map[string]string{"Origin": "https://app.example.com"}, false},
+		{CSRFOriginAndToken, map[string]string{"Origin": "https://app.example.com", "X-CSRF-Token": token}, true},
+		{CSRFOriginAndToken, map[string]string{"Origin": "https://evil.example.com", "X-CSRF-Token": token}, false},
+		{CSRFToken, map[string]string{"Origin": "https://evil.example.com", "X-CSRF-Token": token}, true},
+	}
+
+	for _, tt := range tests {
+		if err := sm.SetTrustedOrigins(tt.mode, "https://app.example.com", "http://localhost:8080"); err != nil {
+			t.Fatalf("SetTrustedOrigins failed: %s", err)
+		}
+
+		r := httptest.NewRequest("POST", "/api/items", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		ses.req = r
+
+		if ok := ses.CanAct(); ok != tt.ok {
+			t.Errorf("mode %d with %v accepted %v, expected %v", tt.mode, tt.headers, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_ReadOnly(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+
+	ses.Set("user", "bob")
+	ses.Commit()
+	sid := ses.sid
+
+	// Hold the session as a writer would.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+	writer, err := sm.Begin(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	defer writer.Commit()
+
+	done := make(chan *Session)
+	go func() {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+		ro, err := sm.BeginReadOnly(rec, r)
+		if err != nil {
+			t.Errorf("BeginReadOnly failed: %s", err)
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Errorf("read only session set a cookie")
+		}
+		done <- ro
+	}()
+
+	var ro *Session
+	select {
+	case ro = <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("BeginReadOnly waited for the writer's lock")
+	}
+
+	if ro.Get("user") != "bob" {
+		t.Errorf("read only session got '%s' expected 'bob'", ro.Get("user"))
+	}
+	if err := ro.Commit(); err != nil {
+		t.Errorf("read only Commit returned %s", err)
+	}
+	if err := NewKey[string]("user").Set(ro, "eve"); err != ErrReadOnly {
+		t.Errorf("Key.Set on read only session returned %v", err)
+	}
+	if err := ro.Regenerate(); err != ErrReadOnly {
+		t.Errorf("Regenerate on read only session returned %v", err)
+	}
+
+	if err := ro.Set("user", "eve"); err != ErrReadOnly {
+		t.Errorf("Set on read only session returned %v", err)
+	}
+	if err := ro.AddFlash("info", "hi"); err != ErrReadOnly {
+		t.Errorf("AddFlash on read only session returned %v", err)
+	}
+	if err := ro.Clear(); err != ErrReadOnly {
+		t.Errorf("Clear on read only session returned %v", err)
+	}
+	if ro.Get("user") != "bob" {
+		t.Errorf("read only session changed to '%s'", ro.Get("user"))
+	}
+
+	// Without a session there is nothing to read, and nothing is created.
+	ro, err = sm.BeginReadOnly(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil || ro.sid != "" || len(ro.Values) != 0 {
+		t.Errorf("read only session without a cookie not empty: %v", err)
+	}
+}
@@ -5,10 +5,9 @@ package.
 package session
 
 import (
-	"crypto/rand"
+	"context"
 	"errors"
-	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"sync"
 	"time"
@@ -40,7 +39,8 @@ type SessionStorage interface {
 
 	/*
 		Will be called periodically(see SetGCDelay()) to clean up expired
-		sessions
+		sessions. Stores that support SetMaxLifetime and SetIdleTimeout
+		should also remove sessions past those limits.
 	*/
 	GC() error
 
@@ -50,6 +50,92 @@ type SessionStorage interface {
 	Close() error
 }
 
+/*
+RequestStorage is implemented by storages that keep the session in the request
+itself, such as CookieStore. Begin uses GetRequest in place of Get for them,
+and Middleware commits their sessions before the response is written so they
+can set headers.
+*/
+type RequestStorage interface {
+	SessionStorage
+
+	/*
+		Return the session associated with sid carried by req. Otherwise the
+		same as SessionStorage.Get.
+	*/
+	GetRequest(req *http.Request, sid string) (*Session, error)
+}
+
+/*
+ContextStorage is an optional interface for SessionStorage. Its methods behave
+as their SessionStorage counterparts but give up once ctx is done. The
+SessionManager uses them in preference, with the request's context for Get.
+Commit and Delete get the request's context without its cancellation, so a
+client going away doesn't lose writes.
+*/
+type ContextStorage interface {
+	SessionStorage
+
+	GetContext(ctx context.Context, sid string) (*Session, error)
+	CommitContext(ctx context.Context, session *Session) error
+	DeleteContext(ctx context.Context, session *Session) error
+}
+
+/*
+ContextToucher is the context aware variant of Toucher.
+*/
+type ContextToucher interface {
+	TouchContext(ctx context.Context, session *Session) error
+}
+
+/*
+Toucher is an optional interface for SessionStorage. When a session's values
+are unchanged Commit calls Touch instead, which should only refresh the
+session's last used time rather than rewrite the whole session.
+*/
+type Toucher interface {
+	Touch(session *Session) error
+}
+
+/*
+Lister is an optional interface for SessionStorage. List returns the ids of
+all unexpired sessions.
+*/
+type Lister interface {
+	List() ([]string, error)
+}
+
+/*
+Counter is an optional interface for SessionStorage. Count returns the number
+of unexpired sessions.
+*/
+type Counter interface {
+	Count() (int, error)
+}
+
+/*
+ErrNotSupported is returned when the SessionStorage lacks the optional
+interface an operation needs.
+*/
+var ErrNotSupported = errors.New("not supported by session storage")
+
+/*
+ErrLockTimeout is returned by Begin when the session is still in use by
+another request after the lock timeout, see SetLockTimeout.
+*/
+var ErrLockTimeout = errors.New("timed out waiting for session lock")
+
+/*
+ErrReadOnly is returned when changing a session begun with BeginReadOnly.
+*/
+var ErrReadOnly = errors.New("session is read only")
+
+/*
+ErrCommitted is returned when changing or committing a session that has
+already been committed, as the change would be lost.
+*/
+var ErrCommitted = errors.New("session already committed")
+
 /*
 SessionStorage implementations should return ErrNotFound when Get() finds no
 associated session.
@@ -61,11 +147,42 @@ Session may be used concurrently, but should only be used in conjunction with a
 single HTTP request.
 */
 type Session struct {
-	sid        string
-	req        *http.Request
-	w          http.ResponseWriter
-	cookieName string
-	secure     bool
+	sid    string
+	req    *http.Request
+	w      http.ResponseWriter
+	secure bool
+
+	// lazy sessions have no sid yet, one is assigned on the first write.
+	// idErr holds a failure to assign one, returned by Commit.
+	lazy  bool
+	idErr error
+
+	// lock is our hold on sid in the manager's activeSessions.
+	lock *sidLock
+
+	// readOnly sessions hold no lock and may not be changed.
+	readOnly bool
+
+	// committed sessions have given up their lock and may not be changed.
+	committed bool
+
+	// optimistic sessions hold no lock and check their version on commit
+	// instead.
+	optimistic bool
+
+	// loaded is a copy of Values as they came from storage, nil if the
+	// session must be written in full.
+	loaded map[string]string
+
+	sessionMeta
+
+	// metaChanged marks changes to userID or the client not yet committed.
+	metaChanged bool
+
+	// shown are the flashes queued by the previous request, dropped when this
+	// one commits, queued those added by this request for the next.
+	shown  []Flash
+	queued []Flash
 
 	sm *SessionManager
 	sync.RWMutex
@@ -74,6 +191,31 @@ type Session struct {
 	Values map[string]string
 }
 
+// sessionMeta is what the storage keeps about a session besides its Values.
+type sessionMeta struct {
+	// created is set when a new session is started and persisted by the
+	// storage, lastUsed is when the storage last saw a commit.
+	created  time.Time
+	lastUsed time.Time
+
+	// version is maintained by VersionedStorage.
+	version uint64
+
+	// userID is persisted and indexed by stores implementing UserIndex.
+	userID string
+
+	// lastIP and userAgent describe the client of the latest request.
+	lastIP    string
+	userAgent string
+
+	// binding is the fingerprint of the client the session is bound to, see
+	// SetBinding.
+	binding string
+
+	// flashes holds the encoded flashes queued for the next request.
+	flashes string
+}
+
 /*
 SessionManager type, use NewSessionManager() to create.
 */
@@ -81,17 +223,61 @@ type SessionManager struct {
 	// Set true to require Secure cookies
 	Secure bool
 
+	// Set true to create sessions lazily. New sessions get no id, cookie or
+	// action token and are not committed until a value is first set in them,
+	// so clients that never store anything cost nothing.
+	Lazy bool
+
+	// ErrorLog receives errors that can't be returned to the caller, such as
+	// commit failures in Middleware. If nil the log package's standard logger
+	// is used.
+	ErrorLog *log.Logger
+
+	// ClientIP returns the address of the client making req, recorded in
+	// the session metadata and used by Binding. If nil the host of
+	// RemoteAddr is used, behind a proxy read the header it sets instead.
+	ClientIP func(req *http.Request) string
+
 	gcDelay   time.Duration
 	closeChan chan bool
 
-	cookieName string
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	transport   Transport
+	signingKeys [][]byte
+	idGenerator IDGenerator
+
+	actionKeys     [][]byte
+	actionValidity time.Duration
+
+	csrfMode       CSRFMode
+	trustedOrigins map[string]bool
 
 	storage SessionStorage
 	sync.RWMutex
 
 	closed bool
 
-	activeSessions map[string]chan bool
+	lockTimeout time.Duration
+	maxLockHold time.Duration
+
+	optimistic bool
+	merge      MergeFunc
+
+	distributed bool
+
+	binding *Binding
+
+	activeSessions map[string]*sidLock
+}
+
+// sidLock marks a session id as in use, released is closed when it's freed.
+// shared is set when the storage's SessionLocker lock is also held.
+type sidLock struct {
+	released chan bool
+	acquired time.Time
+	shared   bool
 }
 
 /*
@@ -101,19 +287,42 @@ created SessionStorage and the name of the http cookie to use.
 Once created, SessionManager.Secure can be set to force secure cookies.
 */
 func NewSessionManager(storage SessionStorage, cookieName string) (*SessionManager, error) {
+	return NewSessionManagerWithCookie(storage, CookieConfig{Name: cookieName})
+}
+
+/*
+NewSessionManagerWithCookie is NewSessionManager with full control over the
+session cookie. Returns an error if the cookie configuration is invalid.
+*/
+func NewSessionManagerWithCookie(storage SessionStorage, cookie CookieConfig) (*SessionManager, error) {
+	return NewSessionManagerWithTransport(storage, &cookie)
+}
+
+/*
+NewSessionManagerWithTransport is NewSessionManager with the session id carried
+by transport rather than a cookie, such as a HeaderTransport for API clients.
+*/
+func NewSessionManagerWithTransport(storage SessionStorage, transport Transport) (*SessionManager, error) {
 	var sm SessionManager
 
-	if cookieName == "" {
-		return nil, errors.New("invalid cookie Name")
+	if transport == nil {
+		return nil, errors.New("nil session transport")
+	}
+	if v, ok := transport.(interface{ validate() error }); ok {
+		err := v.validate()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	sm.gcDelay = time.Hour
-	sm.cookieName = cookieName
+	sm.transport = transport
+	sm.idGenerator = HexIDs()
 
 	sm.storage = storage
 	sm.closeChan = make(chan bool)
 
-	sm.activeSessions = make(map[string]chan bool)
+	sm.activeSessions = make(map[string]*sidLock)
 	go sm.gc()
 
 	return &sm, nil
@@ -176,6 +385,117 @@ func (sm *SessionManager) SetGCDelay(delay time.Duration) error {
 	return nil
 }
 
+/*
+SetLockTimeout bounds how long Begin waits for a session in use by another
+request before failing with ErrLockTimeout. Zero, the default, waits until the
+request's context is done.
+*/
+func (sm *SessionManager) SetLockTimeout(timeout time.Duration) error {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if timeout < 0 {
+		return errors.New("negative lock timeout")
+	}
+
+	sm.lockTimeout = timeout
+	return nil
+}
+
+/*
+SetMaxLockHold sets how long a request may hold a session before others are
+allowed to take it from it, guarding against handlers that never Commit.
+Reclaimed locks are logged to ErrorLog and a late Commit by the previous holder
+stores nothing and returns ErrLockTimeout. Zero, the default, never reclaims.
+*/
+func (sm *SessionManager) SetMaxLockHold(hold time.Duration) error {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if hold != 0 && hold < time.Second {
+		return errors.New("max lock hold too short")
+	}
+
+	sm.maxLockHold = hold
+	return nil
+}
+
+/*
+SetIdleTimeout sets how long a session may go unused before it is discarded.
+A timeout of zero, the default, leaves idle expiry to the storage's maxAge.
+The timeout is passed on to the storage if it supports it, so idle sessions
+are also removed by GC and left out of listings.
+*/
+func (sm *SessionManager) SetIdleTimeout(timeout time.Duration) error {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if timeout != 0 && timeout < time.Minute {
+		return errors.New("idle timeout too short")
+	}
+
+	if is, ok := sm.storage.(idleStorage); ok {
+		err := is.SetIdleTimeout(timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	sm.idleTimeout = timeout
+	return nil
+}
+
+// idleStorage is implemented by storages that can expire sessions by idle
+// time shorter than their maxAge.
+type idleStorage interface {
+	SetIdleTimeout(timeout time.Duration) error
+}
+
+/*
+SetMaxLifetime sets the absolute lifetime of a session measured from its
+creation, regardless of use. A lifetime of zero, the default, disables the
+limit. The lifetime is passed on to the storage if it supports it, so expired
+sessions are also removed by GC.
+*/
+func (sm *SessionManager) SetMaxLifetime(lifetime time.Duration) error {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if lifetime != 0 && lifetime < 5*time.Minute {
+		return errors.New("max lifetime too short")
+	}
+
+	if ls, ok := sm.storage.(lifetimeStorage); ok {
+		err := ls.SetMaxLifetime(lifetime)
+		if err != nil {
+			return err
+		}
+	}
+
+	sm.maxLifetime = lifetime
+	return nil
+}
+
+// lifetimeStorage is implemented by storages that can expire sessions by age.
+type lifetimeStorage interface {
+	SetMaxLifetime(lifetime time.Duration) error
+}
+
+// expired reports whether a stored session has outlived either policy.
+// Sessions from storages that don't track the times are never expired here.
+func (sm *SessionManager) expired(stored *Session) bool {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	if sm.idleTimeout != 0 && !stored.lastUsed.IsZero() && time.Since(stored.lastUsed) > sm.idleTimeout {
+		return true
+	}
+	if sm.maxLifetime != 0 && !stored.created.IsZero() && time.Since(stored.created) > sm.maxLifetime {
+		return true
+	}
+	return false
+}
+
 func (sm *SessionManager) gc() {
 	for {
 		select {
@@ -192,101 +512,503 @@ func (sm *SessionManager) gc() {
 	}
 }
 
+/*
+Sessions returns the ids of all unexpired sessions. Requires the storage to
+implement Lister.
+*/
+func (sm *SessionManager) Sessions() ([]string, error) {
+	if l, ok := sm.storage.(Lister); ok {
+		return l.List()
+	}
+	return nil, ErrNotSupported
+}
+
+/*
+Count returns the number of unexpired sessions. Requires the storage to
+implement Counter or Lister.
+*/
+func (sm *SessionManager) Count() (int, error) {
+	if c, ok := sm.storage.(Counter); ok {
+		return c.Count()
+	}
+
+	sids, err := sm.Sessions()
+	if err != nil {
+		return 0, err
+	}
+	return len(sids), nil
+}
+
+func (sm *SessionManager) logf(format string, args ...interface{}) {
+	if sm.ErrorLog != nil {
+		sm.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
 /*
 Begin using a session. Returns a session, resuming an existing session if
 possible and creating a	new session if necessary.
 */
 func (sm *SessionManager) Begin(w http.ResponseWriter, req *http.Request) (*Session, error) {
 	var s Session
-	sidCookie, err := req.Cookie(sm.cookieName)
-	if err == nil && sidCookie.Value != "" {
-		s.sid = sidCookie.Value
+	var err error
 
-		sm.lockSID(s.sid)
+	sm.RLock()
+	s.optimistic = sm.optimistic
+	sm.RUnlock()
 
-		stored, err := sm.storage.Get(s.sid)
+	s.sid = sm.requestSID(req)
+	if s.sid != "" && !s.optimistic {
+		s.lock, err = sm.lockSID(req.Context(), s.sid)
+		if err != nil {
+			return nil, err
+		}
+		err = sm.lockShared(req.Context(), s.sid, s.lock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.sid != "" {
+		stored, err := sm.get(req, s.sid)
 		if err != nil && err != ErrNotFound {
+			sm.unlockSID(s.sid, s.lock)
 			return nil, err
 		}
-		if stored != nil {
+		if stored != nil && !sm.expired(stored) {
 			s.Values = stored.Values
+			s.loaded = copyValues(stored.Values)
+			s.sessionMeta = stored.sessionMeta
 		}
 	}
 
 	s.sm = sm
-	s.cookieName = sm.cookieName
 	s.secure = sm.Secure
 
 	s.req = req
 	s.w = w
+	s.lazy = sm.Lazy
+	s.recordClient()
+
+	regenerated := false
+	if s.Values != nil {
+		regenerated, err = sm.checkBinding(&s)
+		if err != nil {
+			sm.unlockSID(s.sid, s.lock)
+			return nil, err
+		}
+	}
+	s.loadFlashes()
 
 	if s.Values == nil {
-		s.Clear()
-	} else {
-		s.setCookie()
+		err = s.Clear()
+		if err != nil {
+			sm.unlockSID(s.sid, s.lock)
+			return nil, err
+		}
+	} else if !regenerated {
+		s.sendSID()
 	}
 	return &s, nil
 }
 
-func (sm *SessionManager) lockSID(sid string) {
+/*
+BeginReadOnly begins using a session without taking its lock, so read only
+requests run concurrently with each other and with a request using Begin.
+
+The session can't be changed, Set and the other methods changing it return
+ErrReadOnly and Commit does nothing. No new session is created, requests
+without a valid session get an empty one.
+*/
+func (sm *SessionManager) BeginReadOnly(w http.ResponseWriter, req *http.Request) (*Session, error) {
+	var s Session
+
+	s.sm = sm
+	s.secure = sm.Secure
+	s.req = req
+	s.w = w
+	s.readOnly = true
+
+	sid := sm.requestSID(req)
+	if sid != "" {
+		stored, err := sm.get(req, sid)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if stored != nil && !sm.expired(stored) {
+			s.sid = sid
+			s.Values = stored.Values
+			s.sessionMeta = stored.sessionMeta
+		}
+	}
+
+	if s.Values != nil {
+		sm.checkBinding(&s)
+	}
+	s.loadFlashes()
+
+	if s.Values == nil {
+		s.Values = make(map[string]string)
+	}
+	return &s, nil
+}
+
+// requestSID returns the verified session id sent with req, if any.
+func (sm *SessionManager) requestSID(req *http.Request) string {
+	value := sm.transport.SID(req)
+	if value == "" {
+		return ""
+	}
+	return sm.verifySID(value)
+}
+
+func (sm *SessionManager) get(req *http.Request, sid string) (*Session, error) {
+	if rs, ok := sm.storage.(RequestStorage); ok {
+		return rs.GetRequest(req, sid)
+	}
+	if cs, ok := sm.storage.(ContextStorage); ok {
+		return cs.GetContext(req.Context(), sid)
+	}
+	return sm.storage.Get(sid)
+}
+
+func (sm *SessionManager) lockSID(ctx context.Context, sid string) (*sidLock, error) {
+	sm.RLock()
+	lockTimeout := sm.lockTimeout
+	sm.RUnlock()
+
+	var timeout <-chan time.Time
+	if lockTimeout != 0 {
+		timer := time.NewTimer(lockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	// Ensure that each sid is only in use once at a time.
 	for {
 		sm.Lock()
-		ch, inUse := sm.activeSessions[sid]
+		lock, inUse := sm.activeSessions[sid]
+		reclaimShared := false
+		if inUse && sm.maxLockHold != 0 && time.Since(lock.acquired) > sm.maxLockHold {
+			sm.logf("session: reclaimed session lock held for %s, missing Commit?", time.Since(lock.acquired))
+			close(lock.released)
+			delete(sm.activeSessions, sid)
+			inUse = false
+			reclaimShared = lock.shared
+		}
+
 		if !inUse {
-			sm.activeSessions[sid] = make(chan bool)
+			lock = &sidLock{released: make(chan bool), acquired: time.Now()}
+			sm.activeSessions[sid] = lock
 			sm.Unlock()
-			break
-		} else {
-			sm.Unlock()
-			// Wait for whoever is using it to finish.
-			<-ch
+
+			if reclaimShared {
+				sm.unlockShared(sid)
+			}
+			return lock, nil
+		}
+
+		var reclaim <-chan time.Time
+		if sm.maxLockHold != 0 {
+			reclaim = time.After(time.Until(lock.acquired.Add(sm.maxLockHold)))
+		}
+		sm.Unlock()
+
+		// Wait for whoever is using it to finish.
+		select {
+		case <-lock.released:
+		case <-reclaim:
+		case <-timeout:
+			return nil, ErrLockTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
 }
 
-func (sm *SessionManager) unlockSID(sid string) {
-	// Free up our hold on this session id.
+func (sm *SessionManager) unlockSID(sid string, lock *sidLock) {
+	// Free up our hold on this session id, unless it was reclaimed.
 	sm.Lock()
-	ch, inUse := sm.activeSessions[sid]
-	if inUse {
-		close(ch)
+	shared := false
+	if lock != nil && sm.activeSessions[sid] == lock {
+		close(lock.released)
 		delete(sm.activeSessions, sid)
+		shared = lock.shared
 	}
 	sm.Unlock()
+
+	if shared {
+		sm.unlockShared(sid)
+	}
 }
 
 /*
-Commit the session back to storage. MUST be called at the end of each request.
+Commit the session back to storage. MUST be called at the end of each request,
+and before writing the response with storages such as CookieStore that
+set headers. Changing or committing the session again afterwards returns
+ErrCommitted.
+
+Sessions whose Values and metadata are unchanged are only touched by storages
+implementing Toucher, anything else changed on them is not written.
+
+The commit is completed even if the client has gone away.
 */
 func (s *Session) Commit() error {
 	s.Lock()
 	defer s.Unlock()
 
+	if s.idErr != nil {
+		return s.idErr
+	}
+	if s.readOnly {
+		return nil
+	}
+	if s.committed {
+		return ErrCommitted
+	}
+	s.committed = true
+
 	if s.sid != "" {
-		err := s.sm.storage.Commit(s)
-		s.sm.unlockSID(s.sid)
+		if !s.optimistic && !s.holdsLock() {
+			// Our lock was reclaimed, the new holder's changes win. Optimistic
+			// sessions rely on their version instead.
+			s.lock = nil
+			return ErrLockTimeout
+		}
+
+		err := s.store()
+		s.unlock()
 		return err
 	}
 
 	return nil
 }
 
+// holdsLock reports whether the session still holds its session id's lock,
+// the session must be locked.
+func (s *Session) holdsLock() bool {
+	s.sm.RLock()
+	defer s.sm.RUnlock()
+
+	return s.lock != nil && s.sm.activeSessions[s.sid] == s.lock
+}
+
+// store commits the session, or only touches it if unchanged. The session must
+// be locked.
+func (s *Session) store() error {
+	storage := s.sm.storage
+	ctx := s.writeContext()
+
+	err := s.storeFlashes()
+	if err != nil {
+		return err
+	}
+
+	if !s.changed() {
+		if t, ok := storage.(ContextToucher); ok {
+			return t.TouchContext(ctx, s)
+		}
+		if t, ok := storage.(Toucher); ok {
+			return t.Touch(s)
+		}
+	}
+
+	if s.optimistic {
+		return s.commitVersioned()
+	}
+
+	if cs, ok := storage.(ContextStorage); ok {
+		return cs.CommitContext(ctx, s)
+	}
+	return storage.Commit(s)
+}
+
+// remove deletes the session from storage. The session must be locked.
+func (s *Session) remove() error {
+	if cs, ok := s.sm.storage.(ContextStorage); ok {
+		return cs.DeleteContext(s.writeContext(), s)
+	}
+	return s.sm.storage.Delete(s)
+}
+
+// writeContext returns the context for storage writes, which carries the
+// request's values but is not canceled with it, so a disconnecting client
+// can't leave a write half done.
+func (s *Session) writeContext() context.Context {
+	if s.req == nil {
+		return context.Background()
+	}
+	return context.WithoutCancel(s.req.Context())
+}
+
+// changed reports whether Values differ from storage, the session must be
+// locked. Comparing against a copy also catches direct changes to Values.
+func (s *Session) changed() bool {
+	if s.metaChanged || s.loaded == nil || len(s.loaded) != len(s.Values) {
+		return true
+	}
+
+	for k, v := range s.Values {
+		if loaded, ok := s.loaded[k]; !ok || loaded != v {
+			return true
+		}
+	}
+	return false
+}
+
+// release gives up the session without committing it.
+func (s *Session) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.sid != "" && !s.readOnly {
+		s.unlock()
+	}
+}
+
+// unlock gives up our hold on the session id, the session must be locked.
+func (s *Session) unlock() {
+	s.sm.unlockSID(s.sid, s.lock)
+	s.lock = nil
+}
+
+// checkWritable returns why the session can't be changed, if it can't. The
+// session must be locked.
+func (s *Session) checkWritable() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.committed {
+		return ErrCommitted
+	}
+	return nil
+}
+
+// lockNew takes the lock on a freshly made session id, the session must be
+// locked.
+func (s *Session) lockNew() {
+	// Nobody else knows the id, so this never waits.
+	s.lock, _ = s.sm.lockSID(context.Background(), s.sid)
+}
+
 /*
-Clear existing session data leaving a new one.
+Clear existing session data leaving a new one. Returns an error, leaving the
+session unchanged, if a new session id can't be generated.
 */
-func (s *Session) Clear() {
+func (s *Session) Clear() error {
 	s.Lock()
+	if err := s.checkWritable(); err != nil {
+		s.Unlock()
+		return err
+	}
+
+	var sid string
+	if !s.sm.Lazy {
+		var err error
+		sid, err = s.sm.newID()
+		if err != nil {
+			s.Unlock()
+			return err
+		}
+	}
 
-	s.sm.storage.Delete(s)
-	s.sm.unlockSID(s.sid)
+	if s.sid != "" {
+		s.remove()
+		s.unlock()
+	}
 
-	s.sid = makeID()
 	s.Values = make(map[string]string)
+	s.loaded = nil
+	s.sessionMeta = sessionMeta{}
+	s.shown = nil
+	s.queued = nil
+	if s.req != nil {
+		s.recordClient()
+	}
+
+	if s.sm.Lazy {
+		s.sid = ""
+		s.lazy = true
+		s.Unlock()
+		return nil
+	}
+
+	// The new id is locked like any new session so that Commit, which
+	// expects to hold the lock, can store it.
+	s.sid = sid
+	s.lockNew()
+	s.created = time.Now()
+	s.bindLocked()
 	s.Unlock()
 
-	s.setCookie()
+	s.sendSID()
 	s.NewActionToken()
+	return nil
+}
+
+// materialize assigns a lazy session its id and cookie, the session must be
+// locked. Failures are kept for Commit to return as Set has no error.
+func (s *Session) materialize() {
+	if s.sid != "" {
+		return
+	}
+
+	sid, err := s.sm.newID()
+	if err != nil {
+		s.idErr = err
+		return
+	}
+
+	s.sid = sid
+	s.idErr = nil
+	s.lockNew()
+	s.created = time.Now()
+	s.lazy = false
+	s.bindLocked()
+
+	s.sendSID()
+}
+
+/*
+Regenerate moves the session to a new session id while keeping its values. The
+old session is removed from storage. Should be used whenever a session gains
+privileges, such as after logging in, to defeat session fixation.
+*/
+func (s *Session) Regenerate() error {
+	s.Lock()
+	if err := s.checkWritable(); err != nil {
+		s.Unlock()
+		return err
+	}
+
+	if s.sid == "" {
+		// Lazy session with nothing to move.
+		s.Unlock()
+		return nil
+	}
+
+	sid, err := s.sm.newID()
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+
+	err = s.remove()
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+
+	s.unlock()
+	s.sid = sid
+	s.loaded = nil
+	s.version = 0
+	s.lockNew()
+	s.Unlock()
+
+	s.sendSID()
+	return nil
 }
 
 /*
@@ -294,24 +1016,42 @@ ActionToken will return a token which can be embedded into forms to prevent
 cross site request attacks.
 */
 func (s *Session) ActionToken() string {
+	if s.sm.derivedTokens() {
+		return s.ActionTokenFor("")
+	}
+
 	sat := s.Get("actionToken")
 	if sat != "" {
 		return sat
 	}
+
+	// Lazy sessions only get a token once one is asked for.
+	if s.isLazy() {
+		return s.NewActionToken()
+	}
 	return "error"
 }
 
+func (s *Session) isLazy() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.lazy
+}
+
 /*
 CanAct checks the current action token against the token in the request.
-Expects a form value named "actionToken". Returns true if it's a real request.
+Expects an X-CSRF-Token header or a form value named "actionToken", holding
+either ActionToken or MaskedActionToken. Returns true if it's a real request.
+
+With SetActionTokenKeys tokens from ActionTokenFor the request's path are also
+accepted. SetTrustedOrigins can add or substitute a check of the request's
+origin.
 */
 func (s *Session) CanAct() bool {
-	at := s.req.FormValue("actionToken")
-	sat := s.Get("actionToken")
-	if sat != "" && at != "error" && at == sat {
-		return true
-	}
-	return false
+	return s.canAct(func() bool {
+		return s.validToken(s.requestToken())
+	})
 }
 
 /*
@@ -319,7 +1059,23 @@ NewActionToken resets the action token, should be used after each checked
 action is performed.
 */
 func (s *Session) NewActionToken() string {
-	s.Set("actionToken", makeID())
+	if s.sm.derivedTokens() {
+		// Derived tokens are never stored, a new one is simply a fresh
+		// timestamp.
+		return s.ActionToken()
+	}
+
+	token, err := newToken()
+	if err != nil {
+		// No token is better than a predictable one, nothing can pass
+		// CanAct until a new one is made.
+		s.Delete("actionToken")
+		return "error"
+	}
+
+	if s.Set("actionToken", token) != nil {
+		return "error"
+	}
 	return s.ActionToken()
 }
 
@@ -336,32 +1092,38 @@ func (s *Session) Get(key string) string {
 }
 
 /*
-Set a session variable.
+Set a session variable. Returns ErrReadOnly for read only sessions and
+ErrCommitted once the session is committed.
 */
-func (s *Session) Set(key string, value string) {
+func (s *Session) Set(key string, value string) error {
 	s.Lock()
 	defer s.Unlock()
 
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	s.materialize()
 	s.Values[key] = value
+	return nil
 }
 
-func (s *Session) setCookie() {
-	var sessionCookie http.Cookie
+/*
+Delete a session variable. Fails as Set does.
+*/
+func (s *Session) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
 
-	sessionCookie.Name = s.cookieName
-	sessionCookie.Value = s.sid
-	sessionCookie.Path = "/"
-	sessionCookie.MaxAge = 86400 * 30
-	sessionCookie.HttpOnly = true
-	if s.secure {
-		sessionCookie.Secure = true
+	if err := s.checkWritable(); err != nil {
+		return err
 	}
 
-	http.SetCookie(s.w, &sessionCookie)
+	delete(s.Values, key)
+	return nil
 }
 
-func makeID() string {
-	buf := make([]byte, 32)
-	io.ReadFull(rand.Reader, buf)
-	return fmt.Sprintf("%x", buf)
+// sendSID returns the session id to the client through the transport.
+func (s *Session) sendSID() {
+	s.sm.transport.SetSID(s.w, s.sm.signSID(s.sid), s.secure)
 }
@@ -1,10 +1,13 @@
 package session
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
@@ -27,6 +30,13 @@ func (m SessionTestServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			m.t.Errorf("Failed to commit session: %s", err)
 		}
 	}()
+
+	m.handle(w, req, ses)
+}
+
+// handle serves the test requests for ses, used directly when the session
+// comes from Middleware.
+func (m SessionTestServer) handle(w http.ResponseWriter, req *http.Request, ses *Session) {
 	req.ParseForm()
 
 	if sesVarName := req.FormValue("clear"); sesVarName != "" {
@@ -55,6 +65,19 @@ func (m SessionTestServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if msg := req.FormValue("flash"); msg != "" {
+		ses.AddFlash("info", msg)
+		w.Write([]byte(""))
+		return
+	}
+
+	if req.FormValue("flashes") != "" {
+		for _, f := range ses.Flashes() {
+			fmt.Fprintf(w, "%s:%s;", f.Category, f.Message)
+		}
+		return
+	}
+
 	if req.FormValue("delay") != "" {
 		time.Sleep(time.Second)
 		w.Write([]byte(""))
@@ -62,10 +85,8 @@ func (m SessionTestServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-const listen = "localhost:54987"
-
-func req(t *testing.T, c *http.Client, params string) string {
-	resp, err := c.Get(fmt.Sprintf("http://%s/?%s", listen, params))
+func req(t *testing.T, c *http.Client, base string, params string) string {
+	resp, err := c.Get(fmt.Sprintf("%s/?%s", base, params))
 	if err != nil {
 		t.Errorf("failed http GET: %s", err)
 		return ""
@@ -85,8 +106,8 @@ func req(t *testing.T, c *http.Client, params string) string {
 	return string(bytes)
 }
 
-func getSesID(t *testing.T, jar http.CookieJar) string {
-	cookieURL, err := url.Parse(fmt.Sprintf("http://%s/", listen))
+func getSesID(t *testing.T, jar http.CookieJar, base string) string {
+	cookieURL, err := url.Parse(base + "/")
 	if err != nil {
 		t.Errorf("Invalid cookieURL: %s", err)
 		return ""
@@ -101,7 +122,7 @@ func getSesID(t *testing.T, jar http.CookieJar) string {
 	return ""
 }
 
-func sessionTest(t *testing.T) {
+func sessionTest(t *testing.T, base string) {
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		t.Errorf("failed to create cookiejar: %s", err)
@@ -114,51 +135,51 @@ func sessionTest(t *testing.T) {
 	var sesID, sesID2 string
 
 	// Check for initial empty session ID
-	sesID = getSesID(t, c.Jar)
+	sesID = getSesID(t, c.Jar, base)
 	if sesID != "" {
 		t.Errorf("failed Got session id '%s', expected ''", sesID)
 	}
 	t.Logf("Starting session id: '%s'", sesID)
 
 	// Test for nonexistant session variable
-	str = req(t, c, "get=nothing")
+	str = req(t, c, base, "get=nothing")
 	if str != "NotFound" {
 		t.Errorf("failed get=nothing reported as %s", str)
 	}
 
 	// ensure a session was actually set up
-	sesID = getSesID(t, c.Jar)
+	sesID = getSesID(t, c.Jar, base)
 	if sesID == "" {
 		t.Errorf("failed got session id '%s', expected something", sesID)
 	}
 	t.Logf("Initial session id: '%s'", sesID)
 
 	// test setting a session variable
-	str = req(t, c, "put=something&value=buttes")
+	str = req(t, c, base, "put=something&value=buttes")
 	if str != "" {
 		t.Errorf("failed put=something reported as '%s', expcted ''", str)
 	}
 
 	// test retrieving that variable
-	str = req(t, c, "get=something")
+	str = req(t, c, base, "get=something")
 	if str != "Got: buttes" {
 		t.Errorf("failed get=something reported as '%s', expcted 'Got: buttes'", str)
 	}
 
 	// ensure our session IDs are stable
-	sesID2 = getSesID(t, c.Jar)
+	sesID2 = getSesID(t, c.Jar, base)
 	if sesID2 != sesID {
 		t.Errorf("failed got session id '%s', expected '%s'", sesID2, sesID)
 	}
 
 	// clear the session and make sure it actually got cleared
-	str = req(t, c, "clear=true&get=something")
+	str = req(t, c, base, "clear=true&get=something")
 	if str != "NotFound" {
 		t.Errorf("failed get=something reported as '%s', expcted 'NotFound", str)
 	}
 
 	// make sure we have a new session id
-	sesID2 = getSesID(t, c.Jar)
+	sesID2 = getSesID(t, c.Jar, base)
 	if sesID2 == sesID {
 		t.Errorf("failed Session ID unchanged after clearing, got '%s'.", sesID)
 	}
@@ -167,20 +188,20 @@ func sessionTest(t *testing.T) {
 	// Test lockout of simultaneous sessions
 	begin := time.Now()
 	go func() {
-		req(t, c, "delay=true")
+		req(t, c, base, "delay=true")
 		if time.Since(begin) < time.Second {
 			t.Errorf("delay handler failed to delay, took %.2f seconds.", time.Since(begin).Seconds())
 		}
 	}()
 	go func() {
-		req(t, c, "delay=true")
+		req(t, c, base, "delay=true")
 		if time.Since(begin) < time.Second {
 			t.Errorf("delay handler failed to delay, took %.2f seconds.", time.Since(begin).Seconds())
 		}
 	}()
 
 	time.Sleep(100 * time.Millisecond)
-	str = req(t, c, "get=something")
+	str = req(t, c, base, "get=something")
 	if str != "NotFound" {
 		t.Errorf("failed get=something reported as '%s', expcted 'NotFound'", str)
 	}
@@ -190,5 +211,468 @@ func sessionTest(t *testing.T) {
 		t.Logf("simultaneous session lockout succeded, took %.2f seconds.", time.Since(begin).Seconds())
 	}
 
+	// flash messages survive until the next request and are then cleared
+	req(t, c, base, "flash=hello")
+	str = req(t, c, base, "flashes=true")
+	if str != "info:hello;" {
+		t.Errorf("failed flashes=true reported as '%s', expected 'info:hello;'", str)
+	}
+	str = req(t, c, base, "flashes=true")
+	if str != "" {
+		t.Errorf("failed flashes=true reported as '%s' after reading, expected ''", str)
+	}
+
+	// unread they are dropped after the next request
+	req(t, c, base, "flash=hello")
+	req(t, c, base, "flash=world")
+	str = req(t, c, base, "flashes=true")
+	if str != "info:world;" {
+		t.Errorf("failed flashes=true reported as '%s', expected 'info:world;'", str)
+	}
+
 	t.Logf("All tests completed.")
 }
+
+// countingStore counts the calls the SessionManager makes to a MemoryStore.
+type countingStore struct {
+	*MemoryStore
+	gets    int
+	commits int
+	touches int
+}
+
+func (s *countingStore) GetContext(ctx context.Context, sid string) (*Session, error) {
+	s.gets++
+	return s.MemoryStore.GetContext(ctx, sid)
+}
+
+func (s *countingStore) CommitContext(ctx context.Context, ses *Session) error {
+	s.commits++
+	return s.MemoryStore.CommitContext(ctx, ses)
+}
+
+func (s *countingStore) TouchContext(ctx context.Context, ses *Session) error {
+	s.touches++
+	return s.MemoryStore.TouchContext(ctx, ses)
+}
+
+// newTestSession begins a session backed by a fresh MemoryStore outside of
+// any real http server.
+func newTestSession(t *testing.T) (*SessionManager, *Session) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+
+	return newTestSessionFor(t, sm)
+}
+
+// newTestSessionFor begins a new session with sm.
+func newTestSessionFor(t *testing.T, sm *SessionManager) (*SessionManager, *Session) {
+	ses, err := sm.Begin(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+
+	return sm, ses
+}
+
+func Test_Regenerate(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+
+	ses.Set("cart", "full")
+	err := ses.Commit()
+	if err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+
+	// Resume the session as a new request would.
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "test_session", Value: ses.sid})
+	ses, err = sm.Begin(rec, r)
+	if err != nil {
+		t.Fatalf("failed to resume session: %s", err)
+	}
+
+	oldSID := ses.sid
+	err = ses.Regenerate()
+	if err != nil {
+		t.Fatalf("regenerate failed: %s", err)
+	}
+
+	if ses.sid == oldSID {
+		t.Errorf("session id unchanged after Regenerate")
+	}
+	if ses.Get("cart") != "full" {
+		t.Errorf("values lost after Regenerate")
+	}
+	if _, err := sm.storage.Get(oldSID); err != ErrNotFound {
+		t.Errorf("old session still in storage: %v", err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 || cookies[len(cookies)-1].Value != ses.sid {
+		t.Errorf("cookie not updated to the new session id")
+	}
+
+	// The new id is held and the old one released.
+	sm.Lock()
+	_, newHeld := sm.activeSessions[ses.sid]
+	_, oldHeld := sm.activeSessions[oldSID]
+	sm.Unlock()
+	if !newHeld || oldHeld {
+		t.Errorf("lock not transferred, new held %t old held %t", newHeld, oldHeld)
+	}
+
+	err = ses.Commit()
+	if err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+	stored, err := sm.storage.Get(ses.sid)
+	if err != nil || stored.Values["cart"] != "full" {
+		t.Errorf("regenerated session not committed: %v", err)
+	}
+}
+
+func Test_Expiry(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+
+	err := sm.SetMaxLifetime(time.Hour)
+	if err != nil {
+		t.Fatalf("SetMaxLifetime failed: %s", err)
+	}
+	err = sm.SetIdleTimeout(10 * time.Minute)
+	if err != nil {
+		t.Fatalf("SetIdleTimeout failed: %s", err)
+	}
+
+	resume := func(sid string) *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+		ses, err := sm.Begin(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("failed to resume session: %s", err)
+		}
+		return ses
+	}
+
+	// A young session resumes normally.
+	ses.Set("user", "bob")
+	sid := ses.sid
+	ses.Commit()
+	ses = resume(sid)
+	if ses.sid != sid || ses.Get("user") != "bob" {
+		t.Errorf("fresh session was not resumed")
+	}
+
+	// Past the absolute lifetime it's replaced even though recently used.
+	ses.created = time.Now().Add(-2 * time.Hour)
+	ses.Set("user", "alice")
+	ses.Commit()
+	ses = resume(sid)
+	if ses.sid == sid || ses.Get("user") != "" {
+		t.Errorf("session past max lifetime was resumed")
+	}
+	ses.Commit()
+
+	if _, err := sm.storage.Get(sid); err != ErrNotFound {
+		t.Errorf("expired session still in storage: %v", err)
+	}
+
+	// Idle expiry is judged by the last use reported by the storage.
+	stale := &Session{sessionMeta: sessionMeta{created: time.Now(), lastUsed: time.Now().Add(-time.Hour)}}
+	if !sm.expired(stale) {
+		t.Errorf("idle session not reported as expired")
+	}
+	stale.lastUsed = time.Now()
+	if sm.expired(stale) {
+		t.Errorf("active session reported as expired")
+	}
+
+	// The storage drops idle sessions itself, shortened here below what the
+	// manager allows.
+	store := sm.storage.(*MemoryStore)
+	store.SetIdleTimeout(10 * time.Millisecond)
+	_, ses = newTestSessionFor(t, sm)
+	ses.Set("user", "bob")
+	ses.Commit()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := store.Get(ses.sid); err != ErrNotFound {
+		t.Errorf("idle session still returned by the storage: %v", err)
+	}
+	if count, _ := store.Count(); count != 0 {
+		t.Errorf("idle session still counted by the storage")
+	}
+}
+
+func Test_Lazy(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	counter := &countingStore{MemoryStore: store}
+
+	sm, err := NewSessionManager(counter, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+	sm.Lazy = true
+
+	// Read only requests leave no trace.
+	rec := httptest.NewRecorder()
+	ses, err := sm.Begin(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	if ses.Get("anything") != "" {
+		t.Errorf("lazy session not empty")
+	}
+	ses.Commit()
+
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("cookie set for an unused lazy session")
+	}
+	sm.Lock()
+	active := len(sm.activeSessions)
+	sm.Unlock()
+	if active != 0 {
+		t.Errorf("unused lazy session holds %d locks", active)
+	}
+
+	// The first write creates the session.
+	rec = httptest.NewRecorder()
+	ses, err = sm.Begin(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	ses.Set("user", "bob")
+	err = ses.Commit()
+	if err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != ses.sid {
+		t.Fatalf("no cookie set after the first write")
+	}
+	stored, err := store.Get(ses.sid)
+	if err != nil || stored.Values["user"] != "bob" {
+		t.Errorf("materialized session not committed: %v", err)
+	}
+	// Asking for an action token also creates the session.
+	ses, err = sm.Begin(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	if at := ses.ActionToken(); at == "error" || ses.sid == "" {
+		t.Errorf("lazy session gave action token '%s' without materializing", at)
+	}
+	ses.Commit()
+
+	// Once committed a lazy session has nothing to bind a token to.
+	if err := sm.SetActionTokenKeys(time.Hour, bytes.Repeat([]byte("a"), 32)); err != nil {
+		t.Fatalf("SetActionTokenKeys failed: %s", err)
+	}
+	rec = httptest.NewRecorder()
+	ses, err = sm.Begin(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	ses.Commit()
+	if at := ses.ActionTokenFor("/"); at != "error" || ses.sid != "" {
+		t.Errorf("committed lazy session gave action token '%s'", at)
+	}
+	sm.Lock()
+	active = len(sm.activeSessions)
+	sm.Unlock()
+	if active != 0 || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("token after commit left %d locks and %d cookies", active, len(rec.Result().Cookies()))
+	}
+}
+
+func Test_DirtyTracking(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	counter := &countingStore{MemoryStore: store}
+
+	sm, err := NewSessionManager(counter, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	ses, err := sm.Begin(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("failed to begin session: %s", err)
+	}
+	sid := ses.sid
+	ses.Commit()
+	if counter.commits != 1 || counter.touches != 0 {
+		t.Errorf("new session: %d commits %d touches, expected a commit", counter.commits, counter.touches)
+	}
+
+	resume := func() *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+		ses, err := sm.Begin(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("failed to resume session: %s", err)
+		}
+		return ses
+	}
+
+	// Reading only touches.
+	ses = resume()
+	ses.Get("user")
+	ses.Commit()
+	if counter.commits != 1 || counter.touches != 1 {
+		t.Errorf("read only: %d commits %d touches, expected a touch", counter.commits, counter.touches)
+	}
+
+	// Setting a value to what it already is is no change either.
+	ses = resume()
+	ses.Set("actionToken", ses.ActionToken())
+	ses.Commit()
+	if counter.commits != 1 || counter.touches != 2 {
+		t.Errorf("same value: %d commits %d touches, expected a touch", counter.commits, counter.touches)
+	}
+
+	// Changes made directly to Values are still noticed.
+	ses = resume()
+	ses.Values["user"] = "bob"
+	ses.Commit()
+	if counter.commits != 2 || counter.touches != 2 {
+		t.Errorf("changed: %d commits %d touches, expected a commit", counter.commits, counter.touches)
+	}
+
+	stored, err := store.Get(sid)
+	if err != nil || stored.Values["user"] != "bob" {
+		t.Errorf("change not committed: %v", err)
+	}
+}
+
+// listOnlyStore hides everything but List from the optional interfaces.
+type listOnlyStore struct {
+	SessionStorage
+	l Lister
+}
+
+func (s listOnlyStore) List() ([]string, error) {
+	return s.l.List()
+}
+
+// Close leaves the wrapped storage to its own manager.
+func (s listOnlyStore) Close() error {
+	return nil
+}
+
+func Test_OptionalInterfaces(t *testing.T) {
+	sm, ses := newTestSession(t)
+	defer sm.Close()
+	ses.Commit()
+
+	_, ses = newTestSessionFor(t, sm)
+	ses.Commit()
+
+	sids, err := sm.Sessions()
+	if err != nil || len(sids) != 2 {
+		t.Errorf("Sessions returned %v, %v expected 2 ids", sids, err)
+	}
+	if count, err := sm.Count(); err != nil || count != 2 {
+		t.Errorf("Count returned %d, %v expected 2", count, err)
+	}
+
+	// Count falls back to List.
+	store := sm.storage.(*MemoryStore)
+	listOnly, err := NewSessionManager(listOnlyStore{store, store}, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer listOnly.Close()
+	if count, err := listOnly.Count(); err != nil || count != 2 {
+		t.Errorf("Count via List returned %d, %v expected 2", count, err)
+	}
+
+	// And reports storages with neither.
+	cookies, err := NewCookieStore(CookieConfig{Name: "test_data"}, time.Hour, make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to create cookie store: %s", err)
+	}
+	neither, err := NewSessionManager(cookies, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer neither.Close()
+	if _, err := neither.Count(); err != ErrNotSupported {
+		t.Errorf("Count without support returned %v expected ErrNotSupported", err)
+	}
+}
+
+// blockedStore never answers Get until its context is done.
+type blockedStore struct {
+	*MemoryStore
+}
+
+func (s blockedStore) GetContext(ctx context.Context, sid string) (*Session, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func Test_BeginContext(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+
+	sm, err := NewSessionManager(blockedStore{store}, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.AddCookie(&http.Cookie{Name: "test_session", Value: "abc"})
+
+	_, err = sm.Begin(httptest.NewRecorder(), r)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Begin returned %v, expected the context's deadline error", err)
+	}
+}
+
+func Test_CommitAfterCancel(t *testing.T) {
+	sm, _ := newTestSession(t)
+	defer sm.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	ses, err := sm.Begin(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	ses.Set("user", "bob")
+
+	// The client going away must not lose the write.
+	cancel()
+	if err := ses.Commit(); err != nil {
+		t.Errorf("Commit after the client went away returned %s", err)
+	}
+
+	stored, err := sm.storage.Get(ses.sid)
+	if err != nil || stored.Values["user"] != "bob" {
+		t.Errorf("session not stored after the client went away: %v", err)
+	}
+}
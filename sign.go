@@ -0,0 +1,92 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+/*
+SetSigningKeys enables HMAC signing of the session id cookie. The first key
+signs new cookies, all keys are accepted when verifying, so keys can be
+rotated by adding a new key in front and dropping the oldest once its cookies
+have expired. Cookies with a missing or bad signature are treated as absent
+without consulting the storage.
+
+Calling with no keys disables signing. Enabling signing invalidates existing
+unsigned cookies.
+*/
+func (sm *SessionManager) SetSigningKeys(keys ...[]byte) error {
+	for _, key := range keys {
+		if len(key) < 32 {
+			return errors.New("signing key too short, need at least 32 bytes")
+		}
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.signingKeys = copyKeys(keys)
+	return nil
+}
+
+// copyKeys returns a deep copy of keys, so callers can't change them later.
+func copyKeys(keys [][]byte) [][]byte {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	copied := make([][]byte, len(keys))
+	for i, key := range keys {
+		copied[i] = append([]byte(nil), key...)
+	}
+	return copied
+}
+
+// signSID returns the cookie value for sid.
+func (sm *SessionManager) signSID(sid string) string {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	if len(sm.signingKeys) == 0 {
+		return sid
+	}
+	return sid + "." + base64.RawURLEncoding.EncodeToString(sidMAC(sm.signingKeys[0], sid))
+}
+
+// verifySID returns the sid carried by a cookie value, or "" if signing is
+// enabled and the value isn't signed by one of the keys.
+func (sm *SessionManager) verifySID(value string) string {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	if len(sm.signingKeys) == 0 {
+		return value
+	}
+
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return ""
+	}
+	sid := value[:i]
+
+	mac, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return ""
+	}
+
+	for _, key := range sm.signingKeys {
+		if hmac.Equal(mac, sidMAC(key, sid)) {
+			return sid
+		}
+	}
+	return ""
+}
+
+func sidMAC(key []byte, sid string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(sid))
+	return h.Sum(nil)
+}
@@ -0,0 +1,103 @@
+package session
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_SignedCookies(t *testing.T) {
+	mem, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	store := &countingStore{MemoryStore: mem}
+
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	newKey := bytes.Repeat([]byte("n"), 32)
+
+	if err := sm.SetSigningKeys([]byte("short")); err == nil {
+		t.Errorf("short signing key accepted")
+	}
+	if err := sm.SetSigningKeys(oldKey); err != nil {
+		t.Fatalf("SetSigningKeys failed: %s", err)
+	}
+
+	begin := func(value string) (*Session, string) {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			r.AddCookie(&http.Cookie{Name: "test_session", Value: value})
+		}
+		ses, err := sm.Begin(rec, r)
+		if err != nil {
+			t.Fatalf("failed to begin session: %s", err)
+		}
+		cookies := rec.Result().Cookies()
+		ses.Set("seen", "yes")
+		ses.Commit()
+		return ses, cookies[len(cookies)-1].Value
+	}
+
+	ses, signed := begin("")
+	if !strings.HasPrefix(signed, ses.sid+".") {
+		t.Fatalf("cookie '%s' is not a signed '%s'", signed, ses.sid)
+	}
+	sid := ses.sid
+
+	// Correctly signed cookies resume the session.
+	ses, _ = begin(signed)
+	if ses.sid != sid {
+		t.Errorf("signed cookie did not resume the session")
+	}
+
+	// Forged cookies never reach the storage.
+	gets := store.gets
+	for _, forged := range []string{sid, sid + ".AAAA", "garbage"} {
+		ses, _ = begin(forged)
+		if ses.sid == sid {
+			t.Errorf("forged cookie '%s' resumed the session", forged)
+		}
+	}
+	if store.gets != gets {
+		t.Errorf("storage consulted %d times for forged cookies", store.gets-gets)
+	}
+
+	// After rotation old cookies still work and are re-signed.
+	if err := sm.SetSigningKeys(newKey, oldKey); err != nil {
+		t.Fatalf("SetSigningKeys failed: %s", err)
+	}
+	ses, resigned := begin(signed)
+	if ses.sid != sid {
+		t.Errorf("cookie signed by old key did not resume the session")
+	}
+	if resigned == signed {
+		t.Errorf("cookie not re-signed with the current key")
+	}
+
+	// Once the old key is dropped its cookies are rejected.
+	if err := sm.SetSigningKeys(newKey); err != nil {
+		t.Fatalf("SetSigningKeys failed: %s", err)
+	}
+	if ses, _ = begin(signed); ses.sid == sid {
+		t.Errorf("cookie signed by a retired key resumed the session")
+	}
+	if ses, _ = begin(resigned); ses.sid != sid {
+		t.Errorf("re-signed cookie did not resume the session")
+	}
+
+	// Changing the caller's key afterwards doesn't change the signing key.
+	newKey[0] = 'x'
+	if ses, _ = begin(resigned); ses.sid != sid {
+		t.Errorf("signing key changed with the caller's slice")
+	}
+}
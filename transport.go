@@ -0,0 +1,96 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+Transport carries the session id between client and server, see
+NewSessionManagerWithTransport. CookieConfig is the default Transport.
+
+Values are the session id as signed by SetSigningKeys and should be treated as
+opaque by both the transport and the client.
+*/
+type Transport interface {
+	/*
+		Return the session id value sent with req, or "" if there is none.
+	*/
+	SID(req *http.Request) string
+
+	/*
+		Return value to the client. Called whenever a session is begun,
+		created or moved to a new id, before the response is written. secure is
+		SessionManager.Secure.
+	*/
+	SetSID(w http.ResponseWriter, value string, secure bool)
+}
+
+/*
+HeaderTransport carries the session id in request and response headers, for
+API and mobile clients that don't keep cookies.
+
+Clients send the id in Header and must replace their stored id whenever a
+response carries ResponseHeader, as it does for new sessions and after
+Regenerate. Requests without a valid id start a new session.
+*/
+type HeaderTransport struct {
+	// Header the client sends the id in. With "Authorization" the id is
+	// sent as a bearer token, "Authorization: Bearer <id>".
+	Header string
+
+	// ResponseHeader the id is returned in. Defaults to Header, or to
+	// "X-Session-Token" for bearer tokens.
+	ResponseHeader string
+}
+
+const defaultTokenHeader = "X-Session-Token"
+
+/*
+NewBearerTransport returns a HeaderTransport reading the session id from the
+Authorization header as a bearer token and returning it in X-Session-Token.
+*/
+func NewBearerTransport() *HeaderTransport {
+	return &HeaderTransport{Header: "Authorization"}
+}
+
+// bearer reports whether the id is sent as an Authorization bearer token.
+func (t *HeaderTransport) bearer() bool {
+	return http.CanonicalHeaderKey(t.Header) == "Authorization"
+}
+
+// SID returns the session id sent in Header.
+func (t *HeaderTransport) SID(req *http.Request) string {
+	value := req.Header.Get(t.Header)
+	if !t.bearer() {
+		return value
+	}
+
+	scheme, token, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// SetSID returns the session id in ResponseHeader.
+func (t *HeaderTransport) SetSID(w http.ResponseWriter, value string, secure bool) {
+	header := t.ResponseHeader
+	if header == "" {
+		header = t.Header
+		if t.bearer() {
+			header = defaultTokenHeader
+		}
+	}
+
+	w.Header().Set(header, value)
+}
+
+// validate checks t has a Header.
+func (t *HeaderTransport) validate() error {
+	if t.Header == "" {
+		return errors.New("invalid transport Header")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_HeaderTransport(t *testing.T) {
+	store, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	defer store.Close()
+
+	if _, err := NewSessionManagerWithTransport(store, &HeaderTransport{}); err == nil {
+		t.Errorf("HeaderTransport without a Header accepted")
+	}
+
+	transports := []struct {
+		transport      *HeaderTransport
+		header, prefix string
+		response       string
+	}{
+		{NewBearerTransport(), "Authorization", "Bearer ", "X-Session-Token"},
+		{&HeaderTransport{Header: "X-Session-Id"}, "X-Session-Id", "", "X-Session-Id"},
+	}
+
+	for _, tt := range transports {
+		// Closing the manager closes its storage, so each gets its own.
+		store, err := NewMemoryStore(60 * time.Minute)
+		if err != nil {
+			t.Fatalf("failed to create memory store: %s", err)
+		}
+		sm, err := NewSessionManagerWithTransport(store, tt.transport)
+		if err != nil {
+			t.Fatalf("failed to create session manager: %s", err)
+		}
+		defer sm.Close()
+
+		rec := httptest.NewRecorder()
+		ses, err := sm.Begin(rec, httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("Begin failed: %s", err)
+		}
+		ses.Set("user", "bob")
+		ses.Commit()
+
+		token := rec.Header().Get(tt.response)
+		if token != ses.sid {
+			t.Fatalf("%s: new session returned '%s' in %s, expected '%s'", tt.header, token, tt.response, ses.sid)
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Errorf("%s: header transport set a cookie", tt.header)
+		}
+
+		// Resume with the returned token, moving it to a new id.
+		rec = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(tt.header, tt.prefix+token)
+		ses, err = sm.Begin(rec, r)
+		if err != nil {
+			t.Fatalf("Begin failed: %s", err)
+		}
+		if ses.sid != token || ses.Get("user") != "bob" {
+			t.Errorf("%s: session not resumed from header", tt.header)
+		}
+
+		ses.Regenerate()
+		ses.Commit()
+		if rec.Header().Get(tt.response) != ses.sid || ses.sid == token {
+			t.Errorf("%s: regenerated id not returned", tt.header)
+		}
+	}
+
+	// Other authorization schemes are not session ids.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Basic Ym9iOnNlY3JldA==")
+	if sid := NewBearerTransport().SID(r); sid != "" {
+		t.Errorf("Basic authorization read as session id '%s'", sid)
+	}
+}
@@ -0,0 +1,132 @@
+package session
+
+import (
+	"context"
+)
+
+/*
+UserIndex is an optional interface for SessionStorage keeping an index of
+sessions by the user id set with Session.SetUserID. Storages implementing it
+must persist the user id and keep the index up to date on Commit, Delete and
+GC.
+*/
+type UserIndex interface {
+	/*
+		Return the ids of all unexpired sessions belonging to uid.
+	*/
+	SessionsForUser(uid string) ([]string, error)
+}
+
+/*
+SetUserID associates the session with a user, such as after logging in, so
+it's found by SessionManager.SessionsForUser and RevokeUser. Stored with the
+session by storages implementing UserIndex, "" removes the association.
+Fails as Session.Set does.
+*/
+func (s *Session) SetUserID(uid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if uid == s.userID {
+		return nil
+	}
+
+	s.materialize()
+	s.userID = uid
+	s.metaChanged = true
+	return nil
+}
+
+// UserID returns the user id set with SetUserID, or "".
+func (s *Session) UserID() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.userID
+}
+
+/*
+SessionsForUser returns the ids of all unexpired sessions of uid. Returns
+ErrNotSupported if the storage doesn't implement UserIndex. Sessions without a
+user id belong to nobody, so an empty uid has no sessions.
+*/
+func (sm *SessionManager) SessionsForUser(uid string) ([]string, error) {
+	ui, ok := sm.storage.(UserIndex)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if uid == "" {
+		return nil, nil
+	}
+	return ui.SessionsForUser(uid)
+}
+
+/*
+RevokeUser deletes every session of uid, for logging out of all devices or
+after a password change. Returns ErrNotSupported if the storage doesn't
+implement UserIndex. An empty uid revokes nothing.
+
+Each session's lock is taken before deleting it, so a request using it on this
+server, or any server with SetDistributedLocking, finishes first rather than
+committing it again afterwards. ctx bounds the wait along with the lock
+timeout. If a lock can't be had the session is deleted anyway and the error
+returned, as the late commit may bring the session back the call should be
+retried. Optimistic sessions need no lock, their late commits fail with
+ErrConflict.
+
+The session in ctx, as put there by Middleware or NewContext, is not waited
+for. If it belongs to uid it is cleared, leaving the request a new empty
+session.
+*/
+func (sm *SessionManager) RevokeUser(ctx context.Context, uid string) error {
+	sids, err := sm.SessionsForUser(uid)
+	if err != nil {
+		return err
+	}
+
+	sm.RLock()
+	optimistic := sm.optimistic
+	sm.RUnlock()
+
+	var currentSID string
+	current := FromContext(ctx)
+	if current != nil && !current.readOnly {
+		current.RLock()
+		currentSID = current.sid
+		current.RUnlock()
+	}
+
+	var lockErr error
+	for _, sid := range sids {
+		if sid == currentSID {
+			err = current.Clear()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var lock *sidLock
+		if !optimistic {
+			lock, err = sm.lockSID(ctx, sid)
+			if err == nil {
+				err = sm.lockShared(ctx, sid, lock)
+			}
+			if err != nil {
+				lock = nil
+				lockErr = err
+			}
+		}
+
+		err = sm.storage.Delete(&Session{sid: sid, sessionMeta: sessionMeta{userID: uid}})
+		sm.unlockSID(sid, lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	return lockErr
+}
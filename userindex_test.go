@@ -0,0 +1,140 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_UserIndex(t *testing.T) {
+	mem, err := NewMemoryStore(60 * time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create memory store: %s", err)
+	}
+	userIndexTest(t, mem)
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "users.db"), 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatalf("bolt error: %s", err)
+	}
+	bs, err := NewBoltStore(db, 60*time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %s", err)
+	}
+	userIndexTest(t, bs)
+
+	cs, err := NewCookieStore(CookieConfig{Name: "test_data"}, 60*time.Minute, make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to create cookie store: %s", err)
+	}
+	csm, err := NewSessionManager(cs, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer csm.Close()
+	if _, err := csm.SessionsForUser("bob"); err != ErrNotSupported {
+		t.Errorf("SessionsForUser on CookieStore returned %v", err)
+	}
+}
+
+func userIndexTest(t *testing.T, store SessionStorage) {
+	sm, err := NewSessionManager(store, "test_session")
+	if err != nil {
+		t.Fatalf("failed to create session manager: %s", err)
+	}
+	defer sm.Close()
+
+	login := func(uid string) string {
+		_, ses := newTestSessionFor(t, sm)
+		ses.SetUserID(uid)
+		if err := ses.Commit(); err != nil {
+			t.Fatalf("commit failed: %s", err)
+		}
+		return ses.sid
+	}
+
+	resume := func(sid string) *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "test_session", Value: sid})
+		ses, err := sm.Begin(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Begin failed: %s", err)
+		}
+		return ses
+	}
+
+	sessionsOf := func(uid string) []string {
+		sids, err := sm.SessionsForUser(uid)
+		if err != nil {
+			t.Fatalf("SessionsForUser failed: %s", err)
+		}
+		sort.Strings(sids)
+		return sids
+	}
+
+	phone, laptop, tablet := login("bob"), login("bob"), login("bob")
+	other := login("alice")
+	anonymous := login("")
+
+	// Users persist and moving a session updates the index.
+	ses := resume(tablet)
+	if ses.UserID() != "bob" {
+		t.Errorf("user id not persisted, got '%s'", ses.UserID())
+	}
+	ses.SetUserID("alice")
+	ses.Commit()
+
+	want := []string{phone, laptop}
+	sort.Strings(want)
+	if got := sessionsOf("bob"); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("bob has sessions %v, expected %v", got, want)
+	}
+	if got := sessionsOf("alice"); len(got) != 2 {
+		t.Errorf("alice has sessions %v, expected 2", got)
+	}
+
+	// Revoke from a request on the phone while the laptop is mid request.
+	current := resume(phone)
+	busy := resume(laptop)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		busy.Set("late", "write")
+		busy.Commit()
+	}()
+
+	err = sm.RevokeUser(NewContext(context.Background(), current), "bob")
+	if err != nil {
+		t.Fatalf("RevokeUser failed: %s", err)
+	}
+	if current.sid == phone || current.UserID() != "" {
+		t.Errorf("current session not cleared by RevokeUser")
+	}
+	current.Commit()
+
+	if got := sessionsOf("bob"); len(got) != 0 {
+		t.Errorf("bob still has sessions %v after RevokeUser", got)
+	}
+	if _, err := store.Get(laptop); err != ErrNotFound {
+		t.Errorf("late commit brought back a revoked session")
+	}
+	if _, err := store.Get(other); err != nil {
+		t.Errorf("other user's session removed: %v", err)
+	}
+
+	// Sessions without a user are nobody's to list or revoke.
+	if got := sessionsOf(""); len(got) != 0 {
+		t.Errorf("empty user id has sessions %v", got)
+	}
+	if err := sm.RevokeUser(context.Background(), ""); err != nil {
+		t.Errorf("RevokeUser of empty user id failed: %s", err)
+	}
+	if _, err := store.Get(anonymous); err != nil {
+		t.Errorf("anonymous session removed by RevokeUser: %v", err)
+	}
+}
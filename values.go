@@ -0,0 +1,209 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+ErrNoValue is returned by the typed accessors when no value is stored under
+the requested key.
+*/
+var ErrNoValue = errors.New("no session value")
+
+/*
+ErrTypeMismatch is returned by the typed accessors when the stored value can
+not be decoded as the requested type. Returned errors wrap it, use errors.Is to
+check.
+*/
+var ErrTypeMismatch = errors.New("session value type mismatch")
+
+/*
+Typed values are stored in Values as strings so that every SessionStorage can
+persist them unchanged: ints and bools use strconv, times use RFC 3339 with
+nanoseconds, objects are JSON encoded and gob values are base64 encoded gob.
+*/
+
+// GetInt returns the int stored under key.
+func (s *Session) GetInt(key string) (int, error) {
+	val, err := s.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, mismatch(key, "an int")
+	}
+	return i, nil
+}
+
+// SetInt stores an int under key.
+func (s *Session) SetInt(key string, value int) error {
+	return s.Set(key, strconv.Itoa(value))
+}
+
+// GetBool returns the bool stored under key.
+func (s *Session) GetBool(key string) (bool, error) {
+	val, err := s.lookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, mismatch(key, "a bool")
+	}
+	return b, nil
+}
+
+// SetBool stores a bool under key.
+func (s *Session) SetBool(key string, value bool) error {
+	return s.Set(key, strconv.FormatBool(value))
+}
+
+// GetTime returns the time.Time stored under key.
+func (s *Session) GetTime(key string) (time.Time, error) {
+	val, err := s.lookup(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return time.Time{}, mismatch(key, "a time")
+	}
+	return t, nil
+}
+
+// SetTime stores a time.Time under key.
+func (s *Session) SetTime(key string, value time.Time) error {
+	return s.Set(key, value.Format(time.RFC3339Nano))
+}
+
+/*
+GetObject decodes the JSON value stored under key into v, which must be a
+pointer.
+*/
+func (s *Session) GetObject(key string, v interface{}) error {
+	val, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal([]byte(val), v)
+	if err != nil {
+		return mismatch(key, fmt.Sprintf("a %T", v))
+	}
+	return nil
+}
+
+/*
+SetObject stores v under key using its JSON encoding. Returns an error if v can
+not be encoded or the session can't be changed.
+*/
+func (s *Session) SetObject(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("session value %q: %s", key, err)
+	}
+
+	return s.Set(key, string(b))
+}
+
+/*
+GetGob decodes the gob value stored under key by SetGob into v, which must be
+a pointer.
+*/
+func (s *Session) GetGob(key string, v interface{}) error {
+	val, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(val)
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+	}
+	if err != nil {
+		return mismatch(key, fmt.Sprintf("a gob %T", v))
+	}
+	return nil
+}
+
+/*
+SetGob stores v under key using its gob encoding, for types that implement
+GobEncoder or otherwise don't suit JSON. Returns an error if v can not be
+encoded or the session can't be changed.
+*/
+func (s *Session) SetGob(key string, v interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return fmt.Errorf("session value %q: %s", key, err)
+	}
+
+	return s.Set(key, base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func (s *Session) lookup(key string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	val, ok := s.Values[key]
+	if !ok {
+		return "", fmt.Errorf("session value %q: %w", key, ErrNoValue)
+	}
+	return val, nil
+}
+
+func mismatch(key string, want string) error {
+	return fmt.Errorf("session value %q is not %s: %w", key, want, ErrTypeMismatch)
+}
+
+// encodeValue converts v to its stored form using the same encodings as the
+// typed accessors.
+func encodeValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case int:
+		return strconv.Itoa(val), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case time.Time:
+		return val.Format(time.RFC3339Nano), nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeValue is the inverse of encodeValue, v must be a pointer.
+func decodeValue(stored string, v interface{}) error {
+	var err error
+
+	switch ptr := v.(type) {
+	case *string:
+		*ptr = stored
+	case *int:
+		*ptr, err = strconv.Atoi(stored)
+	case *bool:
+		*ptr, err = strconv.ParseBool(stored)
+	case *time.Time:
+		*ptr, err = time.Parse(time.RFC3339Nano, stored)
+	default:
+		err = json.Unmarshal([]byte(stored), v)
+	}
+
+	return err
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type testCart struct {
+	Items []string
+	Total int
+}
+
+func Test_TypedValues(t *testing.T) {
+	sm, _ := newTestSession(t)
+	defer sm.Close()
+
+	typedValuesTest(t, sm)
+}
+
+// typedValuesTest round trips typed values through the storage of sm.
+func typedValuesTest(t *testing.T, sm *SessionManager) {
+	_, ses := newTestSessionFor(t, sm)
+
+	ses.SetInt("count", 42)
+	ses.SetBool("admin", true)
+	now := time.Now()
+	ses.SetTime("seen", now)
+	err := ses.SetObject("cart", testCart{[]string{"a", "b"}, 3})
+	if err != nil {
+		t.Fatalf("SetObject failed: %s", err)
+	}
+	err = ses.SetGob("gobCart", testCart{[]string{"c"}, 5})
+	if err != nil {
+		t.Fatalf("SetGob failed: %s", err)
+	}
+
+	// Round trip through storage.
+	err = ses.Commit()
+	if err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+	stored, err := sm.storage.Get(ses.sid)
+	if err != nil {
+		t.Fatalf("get failed: %s", err)
+	}
+	stored.sm = sm
+
+	if i, err := stored.GetInt("count"); err != nil || i != 42 {
+		t.Errorf("GetInt got %d, %v expected 42", i, err)
+	}
+	if b, err := stored.GetBool("admin"); err != nil || !b {
+		t.Errorf("GetBool got %t, %v expected true", b, err)
+	}
+	if tm, err := stored.GetTime("seen"); err != nil || !tm.Equal(now) {
+		t.Errorf("GetTime got %s, %v expected %s", tm, err, now)
+	}
+	var cart testCart
+	if err := stored.GetObject("cart", &cart); err != nil || cart.Total != 3 || len(cart.Items) != 2 {
+		t.Errorf("GetObject got %+v, %v", cart, err)
+	}
+	var gobCart testCart
+	if err := stored.GetGob("gobCart", &gobCart); err != nil || gobCart.Total != 5 || len(gobCart.Items) != 1 {
+		t.Errorf("GetGob got %+v, %v", gobCart, err)
+	}
+	if err := stored.GetGob("cart", &gobCart); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetGob on JSON expected ErrTypeMismatch, got %v", err)
+	}
+
+	if _, err := stored.GetInt("admin"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetInt on bool expected ErrTypeMismatch, got %v", err)
+	}
+	if _, err := stored.GetTime("count"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetTime on int expected ErrTypeMismatch, got %v", err)
+	}
+	if _, err := stored.GetBool("missing"); !errors.Is(err, ErrNoValue) {
+		t.Errorf("GetBool on missing expected ErrNoValue, got %v", err)
+	}
+}